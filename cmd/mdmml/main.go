@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"net/url"
 	"os"
 
 	"github.com/umemak/mdmml"
@@ -25,7 +24,15 @@ func run(fname string) error {
 	if err != nil {
 		return err
 	}
-	_, err = os.Stdout.Write(mdmml.MDtoMML(src).MMLtoSMF().SMF())
+	mm, err := mdmml.MDtoMMLWithLoader(fname, src, read)
+	if err != nil {
+		return err
+	}
+	mm, err = mm.MMLtoSMFWithError()
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(mm.SMF())
 	if err != nil {
 		return err
 	}
@@ -33,7 +40,7 @@ func run(fname string) error {
 }
 
 func read(fname string) ([]byte, error) {
-	if _, err := url.ParseRequestURI(fname); err == nil {
+	if mdmml.IsURL(fname) {
 		return download(fname)
 	}
 	return os.ReadFile(fname)
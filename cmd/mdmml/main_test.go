@@ -2,6 +2,7 @@ package main
 
 import (
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -31,7 +32,9 @@ func Test_run(t *testing.T) {
 		wantErr bool
 	}{
 		{name: "normal", args: args{fname: "../../testdata/test.md"}},
+		{name: "include", args: args{fname: "../../testdata/include.md"}},
 		{name: "not found", args: args{fname: "notfound"}, wantErr: true},
+		{name: "parse error", args: args{fname: "../../testdata/error.md"}, wantErr: true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -44,6 +47,7 @@ func Test_run(t *testing.T) {
 
 func Test_read(t *testing.T) {
 	testmd, _ := os.ReadFile("../../testdata/test.md")
+	abs, _ := filepath.Abs("../../testdata/test.md")
 	type args struct {
 		fname string
 	}
@@ -54,6 +58,7 @@ func Test_read(t *testing.T) {
 		wantErr bool
 	}{
 		{name: "local", args: args{fname: "../../testdata/test.md"}, want: testmd},
+		{name: "absolute", args: args{fname: abs}, want: testmd},
 		{name: "remote", args: args{fname: "https://raw.githubusercontent.com/umemak/mdmml/main/testdata/test.md"}, want: testmd},
 	}
 	for _, tt := range tests {
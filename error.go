@@ -0,0 +1,46 @@
+package mdmml
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ParseError は Markdown / MML 中の位置付きエラー
+type ParseError struct {
+	File   string // ファイル名
+	Line   int    // Markdown の行(1始まり)
+	Column int    // 表の列(1始まり、1がパート名)。表の外では0
+	Offset int    // MML セル内のバイトオフセット(0始まり)
+	Msg    string
+}
+
+func (e *ParseError) Error() string {
+	pos := ""
+	if e.File != "" {
+		pos = e.File + ":"
+	}
+	pos += fmt.Sprintf("%d", e.Line)
+	if e.Column > 0 {
+		pos += fmt.Sprintf(":%d:%d", e.Column, e.Offset)
+	}
+	return pos + ": " + e.Msg
+}
+
+// ErrorList は収集した ParseError の一覧
+type ErrorList []*ParseError
+
+func (l ErrorList) Error() string {
+	msgs := []string{}
+	for _, e := range l {
+		msgs = append(msgs, e.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Err は一覧が空なら nil を返す
+func (l ErrorList) Err() error {
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
@@ -0,0 +1,46 @@
+package mdmml
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseError_Error(t *testing.T) {
+	tests := []struct {
+		name string
+		err  *ParseError
+		want string
+	}{
+		{name: "cell", err: &ParseError{File: "a.md", Line: 7, Column: 3, Offset: 2, Msg: "msg"}, want: "a.md:7:3:2: msg"},
+		{name: "line", err: &ParseError{File: "a.md", Line: 2, Msg: "msg"}, want: "a.md:2: msg"},
+		{name: "no file", err: &ParseError{Line: 7, Column: 2, Msg: "msg"}, want: "7:2:0: msg"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.err.Error())
+		})
+	}
+}
+
+func TestErrorList_Err(t *testing.T) {
+	tests := []struct {
+		name    string
+		l       ErrorList
+		wantErr string
+	}{
+		{name: "empty", l: ErrorList{}},
+		{name: "nil"},
+		{name: "errors", l: ErrorList{{Line: 1, Msg: "a"}, {Line: 2, Msg: "b"}}, wantErr: "1: a\n2: b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.l.Err()
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package mdmml
+
+import "sort"
+
+// EventKind はイベントの種類
+type EventKind int
+
+const (
+	NoteOff EventKind = iota
+	NoteOn
+	ControlChange
+	ProgramChange
+	PitchBend
+	SysEx
+	Text          // FF 01
+	Copyright     // FF 02
+	TrackName     // FF 03
+	Lyric         // FF 05
+	Marker        // FF 06
+	ChannelPrefix // FF 20
+	Port          // FF 21
+	SetTempo      // FF 51
+	TimeSignature // FF 58
+	KeySignature  // FF 59
+)
+
+// status はチャンネルイベントのステータスバイト、メタイベントの種類
+var status = map[EventKind]int{
+	NoteOff:       0x80,
+	NoteOn:        0x90,
+	ControlChange: 0xB0,
+	ProgramChange: 0xC0,
+	PitchBend:     0xE0,
+	SysEx:         0xF0,
+	Text:          0x01,
+	Copyright:     0x02,
+	TrackName:     0x03,
+	Lyric:         0x05,
+	Marker:        0x06,
+	ChannelPrefix: 0x20,
+	Port:          0x21,
+	SetTempo:      0x51,
+	TimeSignature: 0x58,
+	KeySignature:  0x59,
+}
+
+// Event は絶対 tick を持つ MIDI イベント
+// Data はステータスバイトを除いた内容。メタイベントと SysEx は長さを除いた内容
+type Event struct {
+	Tick    int
+	Channel int
+	Kind    EventKind
+	Data    []byte
+}
+
+// IsMeta はメタイベントなら true
+func (e Event) IsMeta() bool {
+	return e.Kind >= Text
+}
+
+// Sequence はトラックのイベント列
+type Sequence struct {
+	Events []Event
+	End    int // 終端の tick
+}
+
+// Encode はイベントを tick 順に並べ、EOT までの SMF トラックデータにする
+func (s Sequence) Encode() []byte {
+	ret := encode(s.Events)
+	last := 0
+	for _, e := range s.Events {
+		if e.Tick > last {
+			last = e.Tick
+		}
+	}
+	end := s.End
+	if end < last {
+		end = last
+	}
+	ret = append(ret, itob(end-last, 0)...)
+	ret = append(ret, EOT[1:]...)
+	return ret
+}
+
+// delay は全てのイベントと終わりを tick だけ遅らせた Sequence を返す
+func (s Sequence) delay(tick int) Sequence {
+	events := make([]Event, len(s.Events))
+	for i, e := range s.Events {
+		e.Tick += tick
+		events[i] = e
+	}
+	return Sequence{Events: events, End: s.End + tick}
+}
+
+// encode はイベントを tick 順に並べ、デルタタイム付きのバイト列にする
+func encode(events []Event) []byte {
+	sorted := make([]Event, len(events))
+	copy(sorted, events)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Tick != sorted[j].Tick {
+			return sorted[i].Tick < sorted[j].Tick
+		}
+		return sorted[i].Kind == NoteOff && sorted[j].Kind != NoteOff // 同じ tick ではノートオフを先に出す
+	})
+	ret := []byte{}
+	tick := 0
+	for _, e := range sorted {
+		ret = append(ret, itob(e.Tick-tick, 0)...)
+		tick = e.Tick
+		switch {
+		case e.Kind == SysEx:
+			ret = append(ret, 0xF0)
+			ret = append(ret, itob(len(e.Data), 0)...)
+		case e.IsMeta():
+			ret = append(ret, 0xFF)
+			ret = append(ret, itofb(status[e.Kind], 1)...)
+			ret = append(ret, itob(len(e.Data), 0)...)
+		default:
+			ret = append(ret, itofb(status[e.Kind]+e.Channel, 1)...)
+		}
+		ret = append(ret, e.Data...)
+	}
+	return ret
+}
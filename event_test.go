@@ -0,0 +1,112 @@
+package mdmml
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEvent_IsMeta(t *testing.T) {
+	tests := []struct {
+		name string
+		kind EventKind
+		want bool
+	}{
+		{name: "note on", kind: NoteOn, want: false},
+		{name: "sysex", kind: SysEx, want: false},
+		{name: "text", kind: Text, want: true},
+		{name: "tempo", kind: SetTempo, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Event{Kind: tt.kind}.IsMeta()
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestSequence_Encode(t *testing.T) {
+	tests := []struct {
+		name string
+		seq  Sequence
+		want []byte
+	}{
+		{name: "empty", want: []byte{0x00, 0xff, 0x2f, 0x00}},
+		{name: "rest at end", seq: Sequence{
+			Events: []Event{
+				{Tick: 0, Kind: NoteOn, Data: []byte{0x3c, 0x64}},
+				{Tick: 480, Kind: NoteOff, Data: []byte{0x3c, 0x00}},
+			},
+			End: 960,
+		}, want: []byte{
+			0x00, 0x90, 0x3c, 0x64,
+			0x83, 0x60, 0x80, 0x3c, 0x00,
+			0x83, 0x60, 0xff, 0x2f, 0x00,
+		}},
+		{name: "end before last event", seq: Sequence{
+			Events: []Event{{Tick: 480, Channel: 1, Kind: ControlChange, Data: []byte{0x0a, 0x40}}},
+		}, want: []byte{
+			0x83, 0x60, 0xb1, 0x0a, 0x40,
+			0x00, 0xff, 0x2f, 0x00,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.seq.Encode()
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_encode(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []Event
+		want   []byte
+	}{
+		{name: "empty", events: []Event{}, want: []byte{}},
+		{name: "sort", events: []Event{
+			{Tick: 480, Kind: NoteOff, Data: []byte{0x3c, 0x00}},
+			{Tick: 0, Kind: NoteOn, Data: []byte{0x3c, 0x64}},
+			{Tick: 480, Kind: NoteOn, Data: []byte{0x3e, 0x64}},
+		}, want: []byte{
+			0x00, 0x90, 0x3c, 0x64,
+			0x83, 0x60, 0x80, 0x3c, 0x00,
+			0x00, 0x90, 0x3e, 0x64,
+		}},
+		{name: "note off first", events: []Event{
+			{Tick: 480, Kind: ControlChange, Data: []byte{0x0b, 0x64}},
+			{Tick: 480, Kind: NoteOn, Data: []byte{0x3c, 0x64}},
+			{Tick: 480, Kind: NoteOff, Data: []byte{0x3c, 0x00}},
+		}, want: []byte{
+			0x83, 0x60, 0x80, 0x3c, 0x00,
+			0x00, 0xb0, 0x0b, 0x64,
+			0x00, 0x90, 0x3c, 0x64,
+		}},
+		{name: "channel", events: []Event{
+			{Channel: 9, Kind: ProgramChange, Data: []byte{0x12}},
+			{Channel: 15, Kind: PitchBend, Data: []byte{0x00, 0x40}},
+		}, want: []byte{
+			0x00, 0xc9, 0x12,
+			0x00, 0xef, 0x00, 0x40,
+		}},
+		{name: "meta", events: []Event{
+			{Kind: Marker, Data: []byte("A")},
+			{Kind: KeySignature, Data: []byte{0x00, 0x00}},
+		}, want: []byte{
+			0x00, 0xff, 0x06, 0x01, 0x41,
+			0x00, 0xff, 0x59, 0x02, 0x00, 0x00,
+		}},
+		{name: "sysex", events: []Event{
+			{Kind: SysEx, Data: []byte{0x7e, 0x7f, 0x09, 0x01, 0xf7}},
+		}, want: []byte{
+			0x00, 0xf0, 0x05, 0x7e, 0x7f, 0x09, 0x01, 0xf7,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := encode(tt.events)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package mdmml
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// Loader は include するファイル (またはURL) の内容を返す
+type Loader func(name string) ([]byte, error)
+
+// include は src を行に分け、include の行 (!include drums.md) を読み込んだファイルの行に置き換える
+// origin は各行の元のファイルと行番号。stack は include している途中のファイル
+func include(fname string, src []byte, load Loader, stack []string) (lines [][]byte, origin []cell, errs ErrorList) {
+	stack = append(stack, fname)
+	for i, l := range bytes.Split(src, []byte("\n")) {
+		name, ok := includeName(string(l))
+		if !ok {
+			lines = append(lines, l)
+			origin = append(origin, cell{file: fname, line: i + 1})
+			continue
+		}
+		errf := func(format string, a ...interface{}) {
+			errs = append(errs, &ParseError{File: fname, Line: i + 1, Msg: fmt.Sprintf(format, a...)})
+		}
+		if name == "" {
+			errf("missing file name after !include")
+			continue
+		}
+		if load == nil {
+			errf("cannot include %s: no loader", name)
+			continue
+		}
+		target := resolve(fname, name)
+		cycle := false
+		for _, s := range stack {
+			cycle = cycle || s == target
+		}
+		if cycle {
+			errf("include cycle: %s -> %s", strings.Join(stack, " -> "), target)
+			continue
+		}
+		b, err := load(target)
+		if err != nil {
+			errf("cannot include %s: %v", name, err)
+			continue
+		}
+		ls, orig, es := include(target, b, load, stack)
+		lines = append(lines, ls...)
+		origin = append(origin, orig...)
+		errs = append(errs, es...)
+	}
+	return lines, origin, errs
+}
+
+// includeName は include の行ならファイル名を返す
+func includeName(line string) (string, bool) {
+	line = strings.TrimSpace(line)
+	if line != "!include" && !strings.HasPrefix(line, "!include ") {
+		return "", false
+	}
+	return strings.TrimSpace(strings.TrimPrefix(line, "!include")), true
+}
+
+// resolve は include するファイルの名前を、include しているファイルからの相対パスとして解決する
+// URL から include したときは URL として解決する
+func resolve(base, name string) string {
+	if IsURL(name) {
+		return name
+	}
+	if IsURL(base) {
+		u, _ := url.Parse(base)
+		ref, err := url.Parse(filepath.ToSlash(name))
+		if err != nil {
+			return name
+		}
+		return u.ResolveReference(ref).String()
+	}
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(filepath.Dir(base), name)
+}
+
+// IsURL は name が http か https の URL なら true を返す
+func IsURL(name string) bool {
+	u, err := url.Parse(name)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
@@ -0,0 +1,79 @@
+package mdmml
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_include(t *testing.T) {
+	files := map[string]string{
+		"song.md":         "a\n!include lib/drums.md\nb",
+		"lib/drums.md":    "c\n!include fills.md",
+		"lib/fills.md":    "d",
+		"loop.md":         "!include lib/loop.md",
+		"lib/loop.md":     "!include ../loop.md",
+		"missing.md":      "!include nothing.md",
+		"noname.md":       "!include",
+		"http://x/a/s.md": "!include ../b.md",
+		"http://x/b.md":   "e",
+	}
+	load := func(name string) ([]byte, error) {
+		s, ok := files[name]
+		if !ok {
+			return nil, errors.New("not found")
+		}
+		return []byte(s), nil
+	}
+	tests := []struct {
+		name    string
+		want    []string
+		origin  []cell
+		wantErr string
+	}{
+		{name: "song.md", want: []string{"a", "c", "d", "b"},
+			origin: []cell{{file: "song.md", line: 1}, {file: "lib/drums.md", line: 1}, {file: "lib/fills.md", line: 1}, {file: "song.md", line: 3}}},
+		{name: "loop.md", wantErr: "lib/loop.md:1: include cycle: loop.md -> lib/loop.md -> loop.md"},
+		{name: "missing.md", wantErr: "missing.md:1: cannot include nothing.md: not found"},
+		{name: "noname.md", wantErr: "noname.md:1: missing file name after !include"},
+		{name: "http://x/a/s.md", want: []string{"e"}, origin: []cell{{file: "http://x/b.md", line: 1}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines, origin, errs := include(tt.name, []byte(files[tt.name]), load, nil)
+			got := []string{}
+			for _, l := range lines {
+				got = append(got, string(l))
+			}
+			if tt.want != nil {
+				assert.Equal(t, tt.want, got)
+				assert.Equal(t, tt.origin, origin)
+			}
+			if tt.wantErr == "" {
+				assert.NoError(t, errs.Err())
+			} else {
+				assert.EqualError(t, errs.Err(), tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_resolve(t *testing.T) {
+	tests := []struct {
+		base string
+		name string
+		want string
+	}{
+		{base: "songs/a.md", name: "lib/b.md", want: "songs/lib/b.md"},
+		{base: "songs/a.md", name: "../b.md", want: "b.md"},
+		{base: "a.md", name: "/lib/b.md", want: "/lib/b.md"},
+		{base: "https://example.com/songs/a.md", name: "lib/b.md", want: "https://example.com/songs/lib/b.md"},
+		{base: "songs/a.md", name: "https://example.com/b.md", want: "https://example.com/b.md"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, resolve(tt.base, tt.name))
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package mdmml
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// defineMacro は macro の表の行でマクロを定義する。名前は英字で始まる英数字
+func (mm *MDMML) defineMacro(name, body string) bool {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == "" || !isLetter(name[0]) || strings.Trim(name, "abcdefghijklmnopqrstuvwxyz0123456789") != "" {
+		return false
+	}
+	if mm.macros == nil {
+		mm.macros = map[string]string{}
+	}
+	mm.macros[name] = strings.TrimSpace(body)
+	return true
+}
+
+// expandMacros はパート t のセルに書いたマクロの呼び出し (!riff) を展開する
+// 展開したセルには元のセル上のオフセットを origins に記録する
+func (mm *MDMML) expandMacros(t *Track) ErrorList {
+	errs := ErrorList{}
+	for k, m := range t.mmls {
+		if !strings.Contains(m, "!") {
+			continue
+		}
+		x := &expander{macros: mm.macros}
+		out, origins := x.expand(m, nil)
+		for _, e := range x.errs {
+			pe := &ParseError{Offset: e.pos, Msg: fmt.Sprintf("%s: %s", t.name, e.msg)}
+			if k < len(t.cells) {
+				pe.File, pe.Line, pe.Column = t.cells[k].file, t.cells[k].line, t.cells[k].column
+			}
+			errs = append(errs, pe)
+		}
+		if t.origins == nil {
+			t.origins = make([][]int, len(t.mmls))
+		}
+		t.mmls[k], t.origins[k] = out, origins
+	}
+	return errs
+}
+
+// expander はマクロを展開する
+type expander struct {
+	macros map[string]string
+	errs   []macroError
+}
+
+type macroError struct {
+	pos int // セル上のオフセット
+	msg string
+}
+
+// expand は src のマクロの呼び出しを展開した文字列と、各バイトの元のオフセットを返す
+// stack は展開中のマクロの名前。マクロの本体を展開するときは呼び出した位置をオフセットにする
+func (x *expander) expand(src string, stack []string) (string, []int) {
+	var out strings.Builder
+	origins := []int{}
+	write := func(s string, pos int) {
+		out.WriteString(s)
+		for range []byte(s) {
+			origins = append(origins, pos)
+		}
+	}
+	for i := 0; i < len(src); {
+		if src[i] == '"' { // 文字列の中は展開しない
+			j := strings.IndexByte(src[i+1:], '"')
+			if j < 0 {
+				j = len(src)
+			} else {
+				j += i + 2
+			}
+			for p := i; p < j; p++ {
+				out.WriteByte(src[p])
+				origins = append(origins, p)
+			}
+			i = j
+			continue
+		}
+		if src[i] != '!' {
+			out.WriteByte(src[i])
+			origins = append(origins, i)
+			i++
+			continue
+		}
+		at := i
+		name, args, shift, end, closed := parseCall(src, i)
+		i = end
+		if name == "" {
+			x.errs = append(x.errs, macroError{pos: at, msg: "missing macro name after '!'"})
+			continue
+		}
+		if !closed {
+			x.errs = append(x.errs, macroError{pos: at, msg: "unclosed '(' in macro call"})
+			continue
+		}
+		body, ok := x.macros[name]
+		if !ok {
+			x.errs = append(x.errs, macroError{pos: at, msg: fmt.Sprintf("unknown macro %q", name)})
+			continue
+		}
+		cycle := false
+		for _, s := range stack {
+			cycle = cycle || s == name
+		}
+		if cycle {
+			x.errs = append(x.errs, macroError{pos: at, msg: fmt.Sprintf("macro cycle: %s -> %s", strings.Join(stack, " -> "), name)})
+			continue
+		}
+		inner := &expander{macros: x.macros}
+		text, _ := inner.expand(substitute(body, args), append(stack, name))
+		for _, e := range inner.errs {
+			x.errs = append(x.errs, macroError{pos: at, msg: e.msg})
+		}
+		if shift != 0 {
+			text = fmt.Sprintf("_%+d %s _%+d", shift, text, -shift)
+		}
+		write(" "+text+" ", at) // ドラムの音名などが前後とつながらないよう空白で区切る
+	}
+	return out.String(), append(origins, len(src))
+}
+
+// parseCall は src[i] の '!' から始まるマクロの呼び出し !name(arg,...)+n を読み、名前、引数、移調と次のオフセットを返す
+// 引数の ( が閉じていなければ closed が false
+func parseCall(src string, i int) (name string, args []string, shift, end int, closed bool) {
+	j := i + 1
+	if j < len(src) && isLetter(src[j]) {
+		for j < len(src) && (isLetter(src[j]) || src[j] >= '0' && src[j] <= '9') {
+			j++
+		}
+	}
+	name = strings.ToLower(src[i+1 : j])
+	closed = true
+	if j < len(src) && src[j] == '(' {
+		closed = false
+		depth, start := 0, j+1
+		for j++; j < len(src); j++ {
+			c := src[j]
+			if c == '"' {
+				if k := strings.IndexByte(src[j+1:], '"'); k >= 0 {
+					j += k + 1
+				}
+				continue
+			}
+			if c == '(' || c == '[' || c == '{' {
+				depth++
+			}
+			if (c == ',' || c == ')') && depth == 0 {
+				args = append(args, strings.TrimSpace(src[start:j]))
+				start = j + 1
+				if c == ')' {
+					j++
+					closed = true
+					break
+				}
+			}
+			if c == ')' || c == ']' || c == '}' {
+				depth--
+			}
+		}
+	}
+	if j+1 < len(src) && (src[j] == '+' || src[j] == '-') && src[j+1] >= '0' && src[j+1] <= '9' {
+		k := j + 1
+		for k < len(src) && src[k] >= '0' && src[k] <= '9' {
+			k++
+		}
+		shift, _ = strconv.Atoi(src[j:k])
+		j = k
+	}
+	return name, args, shift, j, closed
+}
+
+// substitute はマクロの本体の ?1～?9 を引数で置き換える。足りない引数は空になる
+func substitute(body string, args []string) string {
+	var out strings.Builder
+	for i := 0; i < len(body); i++ {
+		if body[i] == '?' && i+1 < len(body) && body[i+1] >= '1' && body[i+1] <= '9' {
+			if n := int(body[i+1] - '1'); n < len(args) {
+				out.WriteString(args[n])
+			}
+			i++
+			continue
+		}
+		out.WriteByte(body[i])
+	}
+	return out.String()
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
@@ -0,0 +1,71 @@
+package mdmml
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_expander_expand(t *testing.T) {
+	macros := map[string]string{
+		"riff":  "cde",
+		"set":   "@11l8o3v100",
+		"arp":   "l16 ?1 ?2 ?1",
+		"outer": "!riff f",
+		"loopa": "c !loopb",
+		"loopb": "d !loopa",
+	}
+	tests := []struct {
+		name    string
+		src     string
+		want    string
+		origins []int
+		errs    []macroError
+	}{
+		{name: "plain", src: "!riff g", want: " cde  g", origins: []int{0, 0, 0, 0, 0, 5, 6, 7}},
+		{name: "case", src: "!SET c", want: " @11l8o3v100  c"},
+		{name: "args", src: "!arp(c, {ce})", want: " l16 c {ce} c "},
+		{name: "missing args", src: "!arp(c)", want: " l16 c  c "},
+		{name: "transpose", src: "!riff+2 !riff-12", want: " _+2 cde _-2   _-12 cde _+12 "},
+		{name: "nested", src: "!outer", want: "  cde  f "},
+		{name: "string", src: "m\"!riff\" c", want: "m\"!riff\" c"},
+		{name: "unknown", src: "c !xx d", want: "c  d", errs: []macroError{{pos: 2, msg: "unknown macro \"xx\""}}},
+		{name: "missing name", src: "c ! d", want: "c  d", errs: []macroError{{pos: 2, msg: "missing macro name after '!'"}}},
+		{name: "unclosed", src: "!arp(c d", want: "", errs: []macroError{{pos: 0, msg: "unclosed '(' in macro call"}}},
+		{name: "cycle", src: "e !loopa", want: "e  c  d   ", errs: []macroError{{pos: 2, msg: "macro cycle: loopa -> loopb -> loopa"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			x := &expander{macros: macros}
+			got, origins := x.expand(tt.src, nil)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, len(got)+1, len(origins))
+			if tt.origins != nil {
+				assert.Equal(t, tt.origins, origins)
+			}
+			assert.Equal(t, tt.errs, x.errs)
+		})
+	}
+}
+
+func TestMDMML_defineMacro(t *testing.T) {
+	tests := []struct {
+		name string
+		def  string
+		want bool
+	}{
+		{name: "Riff2", def: " l8 cde ", want: true},
+		{name: "2riff", def: "c"},
+		{name: "ri-ff", def: "c"},
+		{name: " ", def: "c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mm := &MDMML{}
+			assert.Equal(t, tt.want, mm.defineMacro(tt.name, tt.def))
+			if tt.want {
+				assert.Equal(t, map[string]string{"riff2": "l8 cde"}, mm.macros)
+			}
+		})
+	}
+}
@@ -3,8 +3,14 @@ package mdmml
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
 	"strconv"
 	"strings"
+
+	"github.com/umemak/mdmml/mml"
 )
 
 var (
@@ -17,15 +23,41 @@ type MDMML struct {
 	divisions int
 	title     string
 	tempo     int
+	transpose int
+	key       *keySignature
+	meter     *timeSignature    // Front Matter の TimeSignature。nil なら 4/4 で小節の長さは検査しない
+	lfoStep   int               // Front Matter の LFOInterval。0 なら分解能の1/16
+	swing     swing             // Front Matter の Swing。percent が 0 なら指定なし
+	human     humanize          // Front Matter の Humanize
+	seed      int64             // Front Matter の Seed
+	drums     map[string]int    // Front Matter の Drums と drum の表で定義したドラムの音名
+	reset     string            // Front Matter の Reset (GM, GS, XG)
+	composer  string            // Front Matter の Composer
+	copyright string            // Front Matter の Copyright
+	macros    map[string]string // macro の表で定義したマクロ
+	autoPad   bool              // Front Matter の AutoPad。短いセルを休符で埋める
 	header    []byte
 	Conductor Track
 	Tracks    []Track
 }
 
 type Track struct {
-	name string
-	mmls []string
-	smf  []byte
+	name     string
+	mmls     []string
+	cells    []cell
+	lyrics   map[int][]string // 歌詞の行 (| A:lyric |) のセルごとの歌詞。キーは mmls の添字
+	sections []int            // Arrangement で並べた各節の最初のセルの添字。nil なら休符で揃えない
+	origins  [][]int          // マクロを展開したセルの各バイトの元のオフセット。展開していないセルは nil
+	Sequence Sequence
+	smf      []byte
+}
+
+// cell は MML セルの Markdown 上の位置
+type cell struct {
+	file   string
+	table  int // 文書の何番目の表か (0 から)
+	line   int
+	column int
 }
 
 func (mm *MDMML) SMF() []byte {
@@ -38,78 +70,441 @@ func (mm *MDMML) SMF() []byte {
 }
 
 func MDtoMML(src []byte) *MDMML {
+	mm, _ := MDtoMMLWithError("", src)
+	return mm
+}
+
+// MDtoMMLWithError は MDtoMML と同じ変換を行い、見つかったエラーを全て返す
+// ファイルは読まないので、include の行はエラーになる
+func MDtoMMLWithError(fname string, src []byte) (*MDMML, error) {
+	return MDtoMMLWithLoader(fname, src, nil)
+}
+
+// MDtoMMLWithLoader は MDtoMMLWithError と同じ変換を行い、include するファイルを load で読む
+// load が nil なら include しない
+func MDtoMMLWithLoader(fname string, src []byte, load Loader) (*MDMML, error) {
 	mm := &MDMML{
 		divisions: 960,
 		tempo:     120,
 	}
-	lines := bytes.Split(src, []byte("\n"))
+	lines, origin, errs := include(fname, src, load, nil)
+	errf := func(i int, format string, a ...interface{}) {
+		errs = append(errs, &ParseError{File: origin[i].file, Line: origin[i].line, Msg: fmt.Sprintf(format, a...)})
+	}
+	sections := []*section{{}} // 最初の見出しより前の表は名前のない節
+	cur := sections[0]
+	var order []step // Arrangement。nil なら文書の順
+	tables := 0
 	for i := 0; i < len(lines); i++ {
+		if bytes.HasPrefix(lines[i], []byte("#")) { // Section
+			cur.tracks = mm.Tracks
+			name := strings.TrimSpace(strings.TrimLeft(string(lines[i]), "#"))
+			cur = nil
+			for _, s := range sections {
+				if s.name == name {
+					cur = s
+				}
+			}
+			if cur == nil {
+				cur = &section{name: name}
+				sections = append(sections, cur)
+			}
+			mm.Tracks = cur.tracks
+			continue
+		}
 		if string(lines[i]) == "---" { // Front Matter
+			start := i
 			i++
 			for ; i < len(lines); i++ {
 				if string(lines[i]) == "---" {
 					break
 				}
+				if strings.TrimSpace(string(lines[i])) == "" {
+					continue
+				}
 				items := strings.Split(string(lines[i]), ":")
 				if len(items) > 2 {
 					items[1] = strings.Join(items[1:], ":")
 				} else if len(items) != 2 {
+					errf(i, "invalid front matter line")
 					continue
 				}
-				if items[0] == "Divisions" {
-					mm.divisions = atoi(items[1], 960)
+				key := strings.TrimSpace(items[0])
+				val := strings.TrimSpace(items[1])
+				if key == "Divisions" {
+					mm.divisions = atoi(val, 0)
+					if mm.divisions < 1 || mm.divisions > 0x7fff {
+						errf(i, "invalid Divisions: %s", val)
+						mm.divisions = 960
+					}
+				}
+				if key == "Tempo" {
+					mm.tempo = atoi(val, 0)
+					if mm.tempo < 1 {
+						errf(i, "invalid Tempo: %s", val)
+						mm.tempo = 120
+					}
+				}
+				if key == "Transpose" {
+					v, err := strconv.Atoi(val)
+					if err != nil {
+						errf(i, "invalid Transpose: %s", val)
+					}
+					mm.transpose = v
+				}
+				if key == "Key" {
+					mm.key = parseKey(val)
+					if mm.key == nil {
+						errf(i, "invalid Key: %s", val)
+					}
+				}
+				if key == "TimeSignature" {
+					mm.meter = parseTimeSignature(val)
+					if mm.meter == nil {
+						errf(i, "invalid TimeSignature: %s", val)
+					}
+				}
+				if key == "LFOInterval" {
+					mm.lfoStep = atoi(val, 0)
+					if mm.lfoStep < 1 {
+						errf(i, "invalid LFOInterval: %s", val)
+						mm.lfoStep = 0
+					}
+				}
+				if key == "Swing" {
+					mm.swing = parseSwing(val)
+					if mm.swing.percent == 0 {
+						errf(i, "invalid Swing: %s", val)
+					}
+				}
+				if key == "Humanize" {
+					h, ok := parseHumanize(val)
+					if !ok {
+						errf(i, "invalid Humanize: %s", val)
+					}
+					mm.human = h
+				}
+				if key == "Seed" {
+					v, err := strconv.ParseInt(val, 10, 64)
+					if err != nil {
+						errf(i, "invalid Seed: %s", val)
+					}
+					mm.seed = v
+				}
+				if key == "Reset" {
+					mm.reset = strings.ToUpper(val)
+					if resets[mm.reset] == nil {
+						errf(i, "invalid Reset: %s", val)
+						mm.reset = ""
+					}
+				}
+				if key == "Drums" {
+					for _, item := range strings.Split(val, ",") {
+						name, num, _ := strings.Cut(item, "=")
+						if !mm.defineDrum(name, num) {
+							errf(i, "invalid Drums: %s", strings.TrimSpace(item))
+						}
+					}
+				}
+				if key == "Title" {
+					mm.title = val
+				}
+				if key == "Arrangement" {
+					order = []step{}
+					for _, name := range strings.Split(val, ",") {
+						order = append(order, step{name: strings.TrimSpace(name), at: origin[i]})
+					}
+				}
+				if key == "AutoPad" {
+					v, err := strconv.ParseBool(val)
+					if err != nil {
+						errf(i, "invalid AutoPad: %s", val)
+					}
+					mm.autoPad = v
 				}
-				if items[0] == "Tempo" {
-					mm.tempo = atoi(items[1], 120)
+				if key == "Composer" {
+					mm.composer = val
 				}
-				if items[0] == "Title" {
-					mm.title = strings.TrimSpace(items[1])
+				if key == "Copyright" {
+					mm.copyright = val
 				}
 			}
+			if i >= len(lines) {
+				errf(start, "unterminated front matter")
+				break
+			}
 		}
 		if bytes.HasPrefix(lines[i], []byte("|")) { // Table
+			table := tables
+			tables++
+			header := splitRow(string(lines[i]))
+			drumMap := len(header) > 2 && strings.EqualFold(strings.TrimSpace(header[1]), "drum")
+			arrangement := len(header) > 2 && strings.EqualFold(strings.TrimSpace(header[1]), "arrangement")
+			macro := len(header) > 2 && strings.EqualFold(strings.TrimSpace(header[1]), "macro")
+			if arrangement && order == nil {
+				order = []step{}
+			}
+			grids := []*grid{}
+			last := map[string][2]int{} // パートごとの直前の行の mm.Tracks の添字と最初のセルの添字
 			i++
 			i++ // Skip header
 			for ; i < len(lines); i++ {
 				if strings.TrimSpace(string(lines[i])) == "" {
 					break
 				}
+				if bytes.HasPrefix(lines[i], []byte("#")) { // 次の節の見出し
+					i--
+					break
+				}
 				if bytes.HasPrefix(lines[i], []byte(";")) { // Comment
 					continue
 				}
-				items := strings.Split(string(lines[i]), "|")
+				items := splitRow(string(lines[i]))
 				if len(items) < 3 {
 					continue
 				}
 				name := strings.Trim(items[1], " ")
+				if arrangement {
+					order = append(order, step{name: name, at: origin[i]})
+					continue
+				}
+				if drumMap {
+					if !mm.defineDrum(name, items[2]) {
+						errf(i, "invalid drum map row: %s", name)
+					}
+					continue
+				}
+				if macro {
+					if !mm.defineMacro(name, items[2]) {
+						errf(i, "invalid macro row: %s", name)
+					}
+					continue
+				}
 				mmls := []string{}
-				for _, ii := range items[2 : len(items)-1] {
+				cells := []cell{}
+				for k, ii := range items[2 : len(items)-1] {
 					mmls = append(mmls, strings.Trim(ii, " "))
+					cells = append(cells, cell{file: origin[i].file, table: table, line: origin[i].line, column: k + 2})
+				}
+				if part, kind, ok := strings.Cut(name, ":"); ok && strings.TrimSpace(kind) == "lyric" { // Lyrics
+					row, ok := last[part]
+					if !ok {
+						errf(i, "lyric row without %s row", part)
+						continue
+					}
+					t := &mm.Tracks[row[0]]
+					if t.lyrics == nil {
+						t.lyrics = map[int][]string{}
+					}
+					for k, m := range mmls {
+						if row[1]+k < len(t.mmls) {
+							t.lyrics[row[1]+k] = strings.Fields(m)
+						}
+					}
+					continue
 				}
-				found := false
-				for i, v := range mm.Tracks {
-					if v.name == name {
-						mm.Tracks[i].mmls = append(mm.Tracks[i].mmls, mmls...)
-						found = true
-						break
+				if part, drum, ok := strings.Cut(name, ":"); ok { // Drum grid
+					var g *grid
+					for _, v := range grids {
+						if v.part == part {
+							g = v
+						}
 					}
+					if g == nil {
+						g = &grid{part: part}
+						g.track, g.start, g.channel = mm.addRow(part, make([]string, len(mmls)), cells)
+						grids = append(grids, g)
+					}
+					g.rows = append(g.rows, gridRow{drum: strings.ToLower(strings.TrimSpace(drum)), steps: mmls, cells: cells})
+					continue
+				}
+				track, start, _ := mm.addRow(name, mmls, cells)
+				last[name] = [2]int{track, start}
+			}
+			meter := timeSignature{num: 4, den: 4}
+			if mm.meter != nil {
+				meter = *mm.meter
+			}
+			for _, g := range grids {
+				mmls := mm.Tracks[g.track].mmls[g.start:]
+				errs = append(errs, g.fill(mmls, meter.ticks(mm.divisions), mm.drums)...)
+				if g.channel {
+					mmls[0] = "$10" + mmls[0]
 				}
-				if !found {
-					mm.Tracks = append(mm.Tracks, Track{
-						name: name,
-						mmls: mmls,
-					})
+			}
+		}
+	}
+	cur.tracks = mm.Tracks
+	var arrErrs ErrorList
+	mm.Tracks, arrErrs = arrange(sections, order)
+	errs = append(errs, arrErrs...)
+	return mm, errs.Err()
+}
+
+// section は見出し (## Chorus) から次の見出しまでの表で作ったパート
+type section struct {
+	name   string
+	tracks []Track
+}
+
+// step は Arrangement に書いた節の名前
+type step struct {
+	name string
+	at   cell
+}
+
+// arrange は節を order の順に並べてパートを組み立てる
+// order が nil なら文書の順に並べ、休符で揃えない。名前のない節は常に先頭に置く
+// パートは文書に最初に現れた順に並べる
+func arrange(sections []*section, order []step) ([]Track, ErrorList) {
+	errs := ErrorList{}
+	seq := sections
+	if order != nil {
+		seq = []*section{sections[0]}
+		for _, o := range order {
+			var s *section
+			for _, v := range sections {
+				if v.name == o.name && o.name != "" {
+					s = v
 				}
 			}
+			if s == nil {
+				errs = append(errs, &ParseError{File: o.at.file, Line: o.at.line, Msg: fmt.Sprintf("unknown section %q", o.name)})
+				continue
+			}
+			seq = append(seq, s)
 		}
 	}
-	return mm
+	var tracks []Track
+	for _, s := range sections {
+		for _, t := range s.tracks {
+			found := false
+			for _, v := range tracks {
+				found = found || v.name == t.name
+			}
+			if !found {
+				tracks = append(tracks, Track{name: t.name})
+			}
+		}
+	}
+	for _, s := range seq {
+		for i := range tracks {
+			t := &tracks[i]
+			if order != nil {
+				t.sections = append(t.sections, len(t.mmls))
+			}
+			for _, st := range s.tracks {
+				if st.name != t.name {
+					continue
+				}
+				for k, v := range st.lyrics {
+					if t.lyrics == nil {
+						t.lyrics = map[int][]string{}
+					}
+					t.lyrics[len(t.mmls)+k] = v
+				}
+				t.mmls = append(t.mmls, st.mmls...)
+				t.cells = append(t.cells, st.cells...)
+			}
+		}
+	}
+	return tracks, errs
 }
 
 func (mm *MDMML) MMLtoSMF() *MDMML {
+	mm, _ = mm.MMLtoSMFWithError()
+	return mm
+}
+
+// MMLtoSMFWithError は MMLtoSMF と同じ変換を行い、MML のエラーを全て返す
+func (mm *MDMML) MMLtoSMFWithError() (*MDMML, error) {
+	errs := ErrorList{}
+	meter := timeSignature{num: 4, den: 4}
+	if mm.meter != nil {
+		meter = *mm.meter
+	}
+	changes := map[changeKey]change{
+		{kind: SetTempo}:      {event: buildTempo(0, mm.tempo)},
+		{kind: TimeSignature}: {event: meter.event(0)},
+	}
+	if mm.key != nil {
+		changes[changeKey{kind: KeySignature}] = change{event: mm.key.event()}
+	}
+	declared := map[changeKey]bool{}
+	loop, loopTrack, end := -1, "", 0
+	for i := range mm.Tracks {
+		errs = append(errs, mm.expandMacros(&mm.Tracks[i])...)
+	}
+	parsed := make([][]mml.Node, len(mm.Tracks))
+	broken := make([]bool, len(mm.Tracks)) // 構文エラーがあればセルの長さを揃える検査をしない
 	for i, t := range mm.Tracks {
-		events := toEvents(expand(strings.Join(t.mmls, "")), i, mm.divisions)
-		mm.Tracks[i].smf = buildSMF(t.name, events, i)
+		nodes, err := mml.Parse(strings.Join(t.mmls, " ")) // ドラムの音名がセルをまたいで続かないよう空白で区切る
+		if el, ok := err.(mml.ErrorList); ok {
+			for _, e := range el {
+				errs = append(errs, t.errorAt(e))
+			}
+			broken[i] = len(el) > 0
+		}
+		parsed[i] = nodes
+	}
+	var fills [][]int
+	if mm.autoPad {
+		fills = padding(mm.Tracks, mm.measureBars(parsed, meter))
+	}
+	lengths := mm.sectionLengths(parsed, meter, fills)
+	bars := make([][]bar, len(mm.Tracks))
+	reported := map[cell]bool{} // 拍子と合わないと報告したセル
+	wait := mm.resetWait()
+	for i, t := range mm.Tracks {
+		c := mm.compiler(i, t, meter)
+		if fills != nil {
+			c.fill = fills[i]
+		}
+		mm.Tracks[i].Sequence = c.compileSections(t.split(parsed[i]), lengths)
+		for _, e := range c.errs {
+			errs = append(errs, t.errorAt(e))
+		}
+		mm.Tracks[i].Sequence = mm.Tracks[i].Sequence.delay(wait)
+		mm.Tracks[i].smf = buildSMF(t.name, mm.Tracks[i].Sequence, i, wait)
+		for _, ch := range c.changes {
+			k := changeKey{kind: ch.event.Kind, tick: ch.event.Tick}
+			if prev := changes[k]; declared[k] && !bytes.Equal(prev.event.Data, ch.event.Data) {
+				errs = append(errs, t.errorAt(&mml.Error{Pos: ch.pos,
+					Msg: fmt.Sprintf("%s at tick %d conflicts with %s", ch.desc, k.tick, prev.desc)}))
+				continue
+			}
+			changes[k] = ch
+			declared[k] = true
+		}
+		if c.loop >= 0 {
+			if loop < 0 {
+				loop, loopTrack = c.loop, t.name
+			} else if c.loop != loop {
+				errs = append(errs, t.errorAt(&mml.Error{Pos: c.loopAt,
+					Msg: fmt.Sprintf("loop point at tick %d does not match %s at tick %d", c.loop, loopTrack, loop)}))
+			}
+		}
+		if c.tick > end {
+			end = c.tick
+		}
+		metered := mm.meter != nil // Front Matter かパートの ts で拍子を指定したら小節の長さを検査する
+		for _, ch := range c.changes {
+			metered = metered || ch.event.Kind == TimeSignature
+		}
+		if metered {
+			for _, e := range t.checkBars(c.bars, mm.divisions) {
+				errs = append(errs, e)
+				reported[cell{file: e.File, line: e.Line, column: e.Column}] = true
+			}
+		}
+		if !broken[i] {
+			bars[i] = c.bars
+		}
+	}
+	for _, e := range checkAlignment(mm.Tracks, bars) {
+		if !reported[cell{file: e.File, line: e.Line, column: e.Column}] {
+			errs = append(errs, e)
+		}
 	}
 	mm.header = MThd
 	mm.header = append(mm.header, []byte{0x00, 0x00, 0x00, 0x06}...) // Length
@@ -117,292 +512,1437 @@ func (mm *MDMML) MMLtoSMF() *MDMML {
 	mm.header = append(mm.header, itofb(len(mm.Tracks)+1, 2)...)     // Tracks
 	mm.header = append(mm.header, itofb(mm.divisions, 2)...)         // Divisions
 
-	title := buildTitle(mm.title)
-	tempo := buildTempo(mm.tempo)
-	smf := MTrk // "MTrk"
-	smf = append(smf, itofb(len(title)+len(tempo)+12, 4)...)
-	smf = append(smf, title...)
-	smf = append(smf, tempo...)
-	smf = append(smf, []byte{0x00, 0xFF, 0x58, 0x04, 0x04, 0x02, 0x18, 0x08}...) // Rhythm 4/4
-	smf = append(smf, EOT...)                                                    // EOT
+	keys := []changeKey{}
+	for k := range changes {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].tick != keys[j].tick {
+			return keys[i].tick < keys[j].tick
+		}
+		return keys[i].kind < keys[j].kind
+	})
+	conductor := Sequence{Events: []Event{buildTitle(mm.title)}}
+	if mm.copyright != "" {
+		conductor.Events = append(conductor.Events, Event{Kind: Copyright, Data: []byte(mm.copyright)})
+	}
+	if mm.composer != "" {
+		conductor.Events = append(conductor.Events, Event{Kind: Text, Data: []byte(mm.composer)})
+	}
+	if mm.reset != "" {
+		conductor.Events = append(conductor.Events, sysEx(0, resets[mm.reset]))
+	}
+	for _, k := range keys {
+		e := changes[k].event
+		if e.Tick > 0 { // 最初の設定はリセットの前に置き、途中の変更はパートと同じだけ遅らせる
+			e.Tick += wait
+		}
+		conductor.Events = append(conductor.Events, e)
+	}
+	if loop >= 0 {
+		conductor.Events = append(conductor.Events,
+			Event{Tick: loop + wait, Kind: Marker, Data: []byte("loopStart")},
+			Event{Tick: end + wait, Kind: Marker, Data: []byte("loopEnd")})
+	}
 	mm.Conductor = Track{
-		name: "Conductor",
-		smf:  smf,
+		name:     "Conductor",
+		Sequence: conductor,
+		smf:      trackChunk(conductor.Encode()),
 	}
-	return mm
+	return mm, errs.Err()
+}
+
+// compiler はパート t を処理する、Front Matter の設定をした compiler を返す
+func (mm *MDMML) compiler(i int, t Track, meter timeSignature) *compiler {
+	c := newCompiler(i, mm.divisions)
+	c.global = mm.transpose
+	if mm.key != nil {
+		c.key = keyAccidentals(mm.key.sf)
+	}
+	c.meter = meter
+	c.tempo = mm.tempo
+	if mm.lfoStep > 0 {
+		c.lfoStep = mm.lfoStep
+	}
+	if mm.swing.percent > 0 {
+		c.swing = mm.swing
+		c.swing.unit = clamp(c.swing.unit, 1, c.div) // @w と同じく音長が 0 tick にならないようにする
+	}
+	if mm.human.tick > 0 || mm.human.vel > 0 {
+		c.human = mm.human
+		c.rnd = rand.New(rand.NewSource(mm.seed + int64(i))) // パートごとに決まった乱数
+	}
+	c.drums = mm.drums
+	c.lyrics = map[int][]string{}
+	for k, v := range t.lyrics {
+		c.lyrics[k] = v
+	}
+	c.bounds = t.bounds()
+	c.parts = t.sections
+	return c
 }
 
-type loop struct {
-	pos   int
-	count int
+// measureBars は全パートを一度処理して、各パートのセルの長さを返す
+func (mm *MDMML) measureBars(parsed [][]mml.Node, meter timeSignature) [][]bar {
+	bars := make([][]bar, len(mm.Tracks))
+	for i, t := range mm.Tracks {
+		c := mm.compiler(i, t, meter)
+		c.compile(parsed[i])
+		bars[i] = c.bars
+	}
+	return bars
 }
 
-// chode
-type note struct {
+// sectionLengths は Arrangement の各節で最も長いパートの長さ (tick) を返す。Arrangement がなければ nil
+// fills が nil でなければ短いセルを埋めた長さで数える
+func (mm *MDMML) sectionLengths(parsed [][]mml.Node, meter timeSignature, fills [][]int) []int {
+	var lengths []int
+	for i, t := range mm.Tracks {
+		if t.sections == nil {
+			continue
+		}
+		c := mm.compiler(i, t, meter)
+		if fills != nil {
+			c.fill = fills[i]
+		}
+		c.compileSections(t.split(parsed[i]), nil)
+		for j, s := range c.spans {
+			if j >= len(lengths) {
+				lengths = append(lengths, s)
+			} else if s > lengths[j] {
+				lengths[j] = s
+			}
+		}
+	}
+	return lengths
+}
+
+// parseSwing は "60" や "60,16" のようなスウィングの指定を解釈する。解釈できなければ percent が 0
+func parseSwing(s string) swing {
+	items := strings.Split(s, ",")
+	if len(items) > 2 {
+		return swing{}
+	}
+	sw := swing{percent: atoi(strings.TrimSpace(items[0]), 0), unit: 8}
+	if len(items) == 2 {
+		sw.unit = atoi(strings.TrimSpace(items[1]), 0)
+	}
+	if sw.percent < 1 || sw.percent > 99 || sw.unit < 1 {
+		return swing{}
+	}
+	return sw
+}
+
+// parseHumanize は "10,8" のようなタイミング (tick) とベロシティの揺れ幅を解釈する
+func parseHumanize(s string) (humanize, bool) {
+	items := strings.Split(s, ",")
+	if len(items) > 2 {
+		return humanize{}, false
+	}
+	h := humanize{tick: atoi(strings.TrimSpace(items[0]), -1)}
+	if len(items) == 2 {
+		h.vel = atoi(strings.TrimSpace(items[1]), -1)
+	}
+	if h.tick < 0 || h.vel < 0 {
+		return humanize{}, false
+	}
+	return h, true
+}
+
+// keySignature は Front Matter の Key で指定した調
+type keySignature struct {
+	sf    int // 正ならシャープ、負ならフラットの数
+	minor bool
+}
+
+// parseKey は "D"、"Bb"、"F#m" のような調名を解釈する。解釈できなければ nil
+func parseKey(s string) *keySignature {
+	majors := map[string]int{
+		"c": 0, "g": 1, "d": 2, "a": 3, "e": 4, "b": 5, "f#": 6, "c#": 7,
+		"f": -1, "bb": -2, "eb": -3, "ab": -4, "db": -5, "gb": -6, "cb": -7,
+	}
+	minors := map[string]int{
+		"a": 0, "e": 1, "b": 2, "f#": 3, "c#": 4, "g#": 5, "d#": 6, "a#": 7,
+		"d": -1, "g": -2, "c": -3, "f": -4, "bb": -5, "eb": -6, "ab": -7,
+	}
+	s = strings.NewReplacer("+", "#", "-", "b").Replace(strings.ToLower(s))
+	if strings.HasSuffix(s, "m") {
+		if sf, ok := minors[strings.TrimSuffix(s, "m")]; ok {
+			return &keySignature{sf: sf, minor: true}
+		}
+		return nil
+	}
+	if sf, ok := majors[s]; ok {
+		return &keySignature{sf: sf}
+	}
+	return nil
+}
+
+// event は調号のメタイベント (FF 59) を返す
+func (k *keySignature) event() Event {
+	mi := byte(0)
+	if k.minor {
+		mi = 1
+	}
+	return Event{Kind: KeySignature, Data: []byte{byte(int8(k.sf)), mi}}
+}
+
+// timeSignature は拍子
+type timeSignature struct {
 	num int
-	vel int
+	den int
 }
 
-func expand(mml string) string {
-	res := ""
-	loops := []loop{}
-	mml = strings.ReplaceAll(mml, " ", "")
-	mml += "   " // インデックス超過対策
-	for i := 0; i < len(mml); i++ {
-		s := string(mml[i])
-		if s == " " {
-			break
+// parseTimeSignature は "3/4" のような拍子を解釈する。分母は 1～64 の2の累乗。解釈できなければ nil
+func parseTimeSignature(s string) *timeSignature {
+	items := strings.Split(s, "/")
+	if len(items) != 2 {
+		return nil
+	}
+	num := atoi(strings.TrimSpace(items[0]), 0)
+	den := atoi(strings.TrimSpace(items[1]), 0)
+	if num < 1 || num > 255 || den < 1 || den > 64 || den&(den-1) != 0 {
+		return nil
+	}
+	return &timeSignature{num: num, den: den}
+}
+
+func (m timeSignature) String() string {
+	return fmt.Sprintf("%d/%d", m.num, m.den)
+}
+
+// ticks は1小節の tick 数を返す
+func (m timeSignature) ticks(div int) int {
+	return div * 4 * m.num / m.den
+}
+
+// event は拍子のメタイベント (FF 58) を返す
+func (m timeSignature) event(tick int) Event {
+	dd := 0
+	for 1<<dd < m.den {
+		dd++
+	}
+	return Event{Tick: tick, Kind: TimeSignature, Data: []byte{byte(m.num), byte(dd), 0x18, 0x08}}
+}
+
+// change は各パートから Conductor に集めるテンポ・拍子の変更
+type change struct {
+	pos   mml.Pos
+	desc  string // エラー表示用 ("tempo 120" など)
+	event Event
+}
+
+// changeKey は同じ時刻の同じ種類の変更をまとめるためのキー
+type changeKey struct {
+	kind EventKind
+	tick int
+}
+
+// bar は表のセル(小節)ごとの長さ
+type bar struct {
+	ticks  int           // セル内の音長の合計
+	passes int           // 繰り返しでセルを演奏した回数
+	meter  timeSignature // セルを最初に演奏したときの拍子
+	seen   bool          // セルを処理したか。音長のないセルも含む
+}
+
+// bounds は連結した MML 上での各セルの開始オフセットを返す
+func (t Track) bounds() []int {
+	ret := []int{}
+	off := 0
+	for _, m := range t.mmls {
+		ret = append(ret, off)
+		off += len(m) + 1
+	}
+	return ret
+}
+
+// checkBars はセルの長さが拍子と合っているか調べる。最初の小節は弱起として短くてもよい
+func (t Track) checkBars(bars []bar, div int) ErrorList {
+	errs := ErrorList{}
+	first := true
+	for k, b := range bars {
+		if !b.seen {
+			continue
 		}
-		if s == "[" { // loop begin
-			loops = append(loops, loop{pos: i, count: -1})
-		} else if s == "]" { // loop end
-			v, l := num(mml[i+1:], 1, 128)
-			c := 2
-			if l > 0 {
-				i = i + l
-				c = v
-			}
-			lp := len(loops) - 1
-			if loops[lp].count == -1 {
-				loops[lp].count = c
+		want := b.meter.ticks(div)
+		got, ok := 0, true // 空のセルや音長のないコマンドだけのセルは 0 tick
+		if b.passes > 0 {
+			got, ok = b.ticks/b.passes, b.ticks%b.passes == 0
+		}
+		ok = ok && (got == want || first && got < want)
+		first = false
+		if ok || k >= len(t.cells) {
+			continue
+		}
+		errs = append(errs, &ParseError{
+			File:   t.cells[k].file,
+			Line:   t.cells[k].line,
+			Column: t.cells[k].column,
+			Msg:    fmt.Sprintf("%s: bar %d is %d ticks, want %d for %s", t.name, k+1, got, want, b.meter),
+		})
+	}
+	return errs
+}
+
+// cellKey は表の中でのセルの位置。同じ cellKey のセルはパートが違っても同じ長さになるべき
+type cellKey struct {
+	file   string
+	table  int
+	row    int // 表の中でそのパートの何行目か
+	column int
+}
+
+// cellKeys は各セルの cellKey を返す
+func (t Track) cellKeys() []cellKey {
+	keys := []cellKey{}
+	rows := map[cell]int{}  // 行 (column は 0) から表の中での行番号
+	count := map[cell]int{} // 表 (line と column は 0) ごとの行数
+	for _, c := range t.cells {
+		line := cell{file: c.file, table: c.table, line: c.line}
+		r, ok := rows[line]
+		if !ok {
+			tbl := cell{file: c.file, table: c.table}
+			r = count[tbl]
+			count[tbl]++
+			rows[line] = r
+		}
+		keys = append(keys, cellKey{file: c.file, table: c.table, row: r, column: c.column})
+	}
+	return keys
+}
+
+// length は1回の演奏でのセルの長さを返す。演奏していないか、繰り返しごとに長さが違えば -1
+func (b bar) length() int {
+	if b.passes == 0 { // 空のセルや音長のないコマンドだけのセル
+		return 0
+	}
+	if b.ticks%b.passes != 0 {
+		return -1
+	}
+	return b.ticks / b.passes
+}
+
+// longest は同じ cellKey のセルで最も長いものの長さとパート
+type longest struct {
+	ticks int
+	name  string
+}
+
+// longestBars は cellKey ごとに最も長いセルを返す
+func longestBars(tracks []Track, bars [][]bar) map[cellKey]longest {
+	ret := map[cellKey]longest{}
+	for i, t := range tracks {
+		keys := t.cellKeys()
+		for k, b := range bars[i] {
+			if k >= len(keys) {
+				continue
 			}
-			if loops[lp].count > 1 {
-				loops[lp].count--
-				i = loops[lp].pos
-			} else {
-				if lp > 0 {
-					loops = loops[:lp-1]
-				}
+			if got := b.length(); got > ret[keys[k]].ticks {
+				ret[keys[k]] = longest{ticks: got, name: t.name}
 			}
-		} else {
-			res += s
 		}
 	}
-	return res
+	return ret
 }
 
-func toEvents(mml string, ch, div int) []byte {
-	events := []byte{}
-	oct := 4
-	vel := 100
-	defTick := lenToTick(div, 8)
-	mml = strings.ToLower(mml)
-	mml = strings.ReplaceAll(mml, " ", "")
-	mml = strings.ReplaceAll(mml, "#", "+")
-	mml += "   " // インデックス超過対策
-	for i := 0; i < len(mml); i++ {
-		s := string(mml[i])
-		if s == " " {
-			break
+// checkAlignment は同じ列のセルの長さがパート間で揃っているか調べる
+// パートの最後のセルと、休符で揃える節の最後のセルは後ろがずれないので調べない
+func checkAlignment(tracks []Track, bars [][]bar) ErrorList {
+	errs := ErrorList{}
+	max := longestBars(tracks, bars)
+	for i, t := range tracks {
+		keys := t.cellKeys()
+		tails := map[int]bool{len(t.cells) - 1: true}
+		for _, s := range t.sections {
+			tails[s-1] = true
 		}
-		if (s >= "a" && s <= "g") || (s == "r") { // note
-			tick := defTick
-			if string(mml[i+1]) == "+" {
-				i++
-				s = s + "+"
-			} else if string(mml[i+1]) == "-" {
-				i++
-				s = s + "-"
-			}
-			v, l := num(mml[i+1:], 1, div)
-			if l > 0 {
-				i = i + l
-				tick = lenToTick(div, v)
+		seen := map[cellKey]bool{}
+		for k, b := range bars[i] {
+			if k >= len(keys) || tails[k] || seen[keys[k]] {
+				continue
 			}
-			if string(mml[i+1]) == "." {
-				i++
-				tick = int(float64(tick) * 1.5)
+			seen[keys[k]] = true
+			want := max[keys[k]]
+			got := b.length()
+			if got < 0 || got == want.ticks {
+				continue
 			}
-			for {
-				if string(mml[i+1]) != "^" {
-					break
-				}
-				i++
-				tick2 := 0
-				v, l := num(mml[i+1:], 1, div)
-				if l > 0 {
-					i = i + l
-					tick2 = lenToTick(div, v)
-				}
-				if string(mml[i+1]) == "." {
-					i++
-					tick2 = int(float64(tick) * 1.5)
-				}
-				tick += tick2
+			errs = append(errs, &ParseError{
+				File:   t.cells[k].file,
+				Line:   t.cells[k].line,
+				Column: t.cells[k].column,
+				Msg:    fmt.Sprintf("%s: bar %d is %d ticks, but %s is %d ticks", t.name, k+1, got, want.name, want.ticks),
+			})
+		}
+	}
+	return errs
+}
+
+// padding は各パートのセルを埋める長さ (tick) を返す。同じ cellKey で最も長いセルに揃える
+func padding(tracks []Track, bars [][]bar) [][]int {
+	max := longestBars(tracks, bars)
+	fills := make([][]int, len(tracks))
+	for i, t := range tracks {
+		for _, key := range t.cellKeys() {
+			fills[i] = append(fills[i], max[key].ticks)
+		}
+	}
+	return fills
+}
+
+// splitRow は表の行を "|" で分割する。"\|" はセル内の "|" として扱う
+func splitRow(line string) []string {
+	items := strings.Split(line, "|")
+	for i := 0; i < len(items)-1; i++ {
+		if strings.HasSuffix(items[i], "\\") {
+			items[i] = strings.TrimSuffix(items[i], "\\") + "|" + items[i+1]
+			items = append(items[:i+1], items[i+2:]...)
+			i--
+		}
+	}
+	return items
+}
+
+// addRow は表の行をパートに追加する。追加したパートの添字と、行の最初のセルの添字を返す
+// パートを新しく作ったなら created が true
+func (mm *MDMML) addRow(name string, mmls []string, cells []cell) (track, start int, created bool) {
+	for i, v := range mm.Tracks {
+		if v.name == name {
+			start = len(v.mmls)
+			mm.Tracks[i].mmls = append(mm.Tracks[i].mmls, mmls...)
+			mm.Tracks[i].cells = append(mm.Tracks[i].cells, cells...)
+			return i, start, false
+		}
+	}
+	mm.Tracks = append(mm.Tracks, Track{
+		name:  name,
+		mmls:  mmls,
+		cells: cells,
+	})
+	return len(mm.Tracks) - 1, 0, true
+}
+
+// defineDrum はドラムの音名 name に音番号 num を割り当てる。解釈できなければ false
+func (mm *MDMML) defineDrum(name, num string) bool {
+	name = strings.ToLower(strings.TrimSpace(name))
+	v, err := strconv.Atoi(strings.TrimSpace(num))
+	if name == "" || strings.Trim(name, "abcdefghijklmnopqrstuvwxyz") != "" || err != nil || v < 0 || v > 127 {
+		return false
+	}
+	if mm.drums == nil {
+		mm.drums = map[string]int{}
+	}
+	mm.drums[name] = v
+	return true
+}
+
+// grid は1つの表にあるパートのドラムのグリッド (| DR:bd | x...x... |)
+type grid struct {
+	part    string
+	track   int  // mm.Tracks の添字
+	start   int  // 最初のセルの添字
+	channel bool // true ならグリッドでパートを作ったので 10ch にする
+	rows    []gridRow
+}
+
+type gridRow struct {
+	drum  string
+	steps []string
+	cells []cell
+}
+
+// fill はグリッドの各列を1小節 (bar tick) の MML にして mmls に入れる
+// 各セルは小節を歩数で等分し、x で鳴らし、X でアクセントを付け、. と - で休む。同じ位置の音は和音にする
+// drums はそれまでに定義したドラムの音名。知らない音名の行はパート名の列にエラーを出して鳴らさない
+func (g *grid) fill(mmls []string, bar int, drums map[string]int) ErrorList {
+	errs := ErrorList{}
+	rows := []gridRow{}
+	for _, r := range g.rows {
+		_, user := drums[r.drum]
+		_, gm := gmDrums[r.drum]
+		if !user && !gm && len(r.cells) > 0 {
+			errs = append(errs, &ParseError{File: r.cells[0].file, Line: r.cells[0].line, Column: 1,
+				Msg: fmt.Sprintf("%s: unknown drum %q", g.part, r.drum)})
+			continue
+		}
+		rows = append(rows, r)
+	}
+	for k := range mmls {
+		hits := map[int][]string{}
+		for _, r := range rows {
+			if k >= len(r.steps) {
+				continue
 			}
-			events = append(events, noteOnOff(ch, oct, s, vel, tick)...)
-		} else if s == "{" { // chode
-			cp := strings.Index(mml[i+1:], "}")
-			cmml := mml[i+1:i+cp+1] + "   "
-			i = i + cp + 1
-			notes := []note{}
-			o := oct
-			for j := 0; j < len(cmml); j++ {
-				s := string(cmml[j])
-				if s == " " {
-					break
-				}
-				if string(cmml[j+1]) == "+" {
-					j++
-					s = s + "+"
-				} else if string(cmml[j+1]) == "-" {
-					j++
-					s = s + "-"
-				} else if s == ">" {
-					o++
+			n := len([]rune(strings.ReplaceAll(r.steps[k], " ", "")))
+			j := 0
+			for off, s := range r.steps[k] {
+				switch s {
+				case ' ':
 					continue
-				} else if s == "<" {
-					o--
-					continue
-				}
-				n := noteNum(o, s)
-				notes = append(notes, note{num: n, vel: vel})
-			}
-			tick := defTick
-			v, l := num(mml[i+1:], 1, div)
-			if l > 0 {
-				i = i + l
-				tick = lenToTick(div, v)
-			}
-			if string(mml[i+1]) == "." {
-				i++
-				tick = int(float64(tick) * 1.5)
-			}
-			for {
-				if string(mml[i+1]) != "^" {
-					break
-				}
-				i++
-				tick2 := 0
-				v, l := num(mml[i+1:], 1, div)
-				if l > 0 {
-					i = i + l
-					tick2 = lenToTick(div, v)
-				}
-				if string(mml[i+1]) == "." {
-					i++
-					tick2 = int(float64(tick) * 1.5)
+				case 'x':
+					hits[j*bar/n] = append(hits[j*bar/n], "*"+r.drum)
+				case 'X':
+					hits[j*bar/n] = append(hits[j*bar/n], "*"+r.drum+"'")
+				case '.', '-':
+				default:
+					errs = append(errs, &ParseError{File: r.cells[k].file, Line: r.cells[k].line, Column: r.cells[k].column,
+						Offset: off, Msg: fmt.Sprintf("%s: invalid grid step %q", g.part, s)})
 				}
-				tick += tick2
+				j++
 			}
-			events = append(events, notesOnOff(ch, notes, tick)...)
-		} else if s == "o" { // octave
-			v, l := num(mml[i+1:], 1, 8)
-			if l > 0 {
-				i = i + l
-				oct = v
-			}
-		} else if s == ">" {
-			oct++
-		} else if s == "<" {
-			oct--
-		} else if s == "l" { // length
-			v, l := num(mml[i+1:], 1, div)
-			if l > 0 {
-				i = i + l
-				defTick = lenToTick(div, v)
+		}
+		ticks := []int{}
+		for t := range hits {
+			ticks = append(ticks, t)
+		}
+		sort.Ints(ticks)
+		ticks = append(ticks, bar)
+		s := ""
+		if ticks[0] > 0 {
+			s = "r%" + strconv.Itoa(ticks[0])
+		}
+		for i, t := range ticks[:len(ticks)-1] {
+			s += "{" + strings.Join(hits[t], "") + "}%" + strconv.Itoa(ticks[i+1]-t)
+		}
+		mmls[k] = s
+	}
+	return errs
+}
+
+// split は構文木を Arrangement の節ごとに分ける。sections が nil なら1つにまとめる
+func (t Track) split(nodes []mml.Node) [][]mml.Node {
+	if t.sections == nil {
+		return [][]mml.Node{nodes}
+	}
+	bounds := t.bounds()
+	parts := make([][]mml.Node, len(t.sections))
+	for _, n := range nodes {
+		j := 0
+		for k, s := range t.sections {
+			if s < len(bounds) && int(n.Pos()) >= bounds[s] {
+				j = k
 			}
-		} else if s == "@" { // program
-			v, l := num(mml[i+1:], 1, 128)
-			if l > 0 {
-				i = i + l
+		}
+		parts[j] = append(parts[j], n)
+	}
+	return parts
+}
+
+// errorAt は連結した MML 上のオフセットを元のセル位置に変換する
+func (t Track) errorAt(e *mml.Error) *ParseError {
+	pe := &ParseError{Offset: int(e.Pos), Msg: fmt.Sprintf("%s: %s", t.name, e.Msg)}
+	for i, m := range t.mmls {
+		if i >= len(t.cells) {
+			break
+		}
+		pe.File = t.cells[i].file
+		pe.Line = t.cells[i].line
+		pe.Column = t.cells[i].column
+		if pe.Offset <= len(m) || i == len(t.mmls)-1 {
+			if i < len(t.origins) && t.origins[i] != nil && pe.Offset < len(t.origins[i]) {
+				pe.Offset = t.origins[i][pe.Offset]
 			}
-			events = append(events, programChange(ch, v)...)
-		} else if s == "p" { // pan
-			v, l := num(mml[i+1:], 0, 127)
-			if l > 0 {
-				i = i + l
+			break
+		}
+		pe.Offset -= len(m) + 1
+	}
+	return pe
+}
+
+// chode
+type note struct {
+	num int
+	vel int
+}
+
+// compiler は構文木を走査してイベントを生成する
+type compiler struct {
+	ch      int
+	div     int
+	oct     int
+	vel     int
+	defTick int
+	gate    int // q (8分率)
+	cut     int // @q (tick)
+	global  int // Front Matter の Transpose
+	shift   int // k, _ による移調
+	key     map[string]int
+	meter   timeSignature
+	tempo   int
+	bend    int // ベンド幅 (半音)
+	steps   int // & でベンドする段数
+	lfos    map[string]*lfo
+	lfoStep int         // LFO のイベントを出す間隔 (tick)
+	ccs     map[int]int // コントロールチェンジの現在の値
+	pb      int         // ピッチベンドの現在の値
+	velStep int         // ( と ) で変えるベロシティ
+	accent  int         // アクセントで加えるベロシティ
+	swing   swing
+	human   humanize
+	rnd     *rand.Rand // human のための乱数。nil なら揺らさない
+	velRamp *velRamp
+	drums   map[string]int   // ユーザー定義のドラムの音名。gmDrums より優先する
+	lyrics  map[int][]string // セルごとのまだ出力していない歌詞
+	loop    int              // ループの開始位置の tick。-1 なら指定なし
+	loopAt  mml.Pos
+	spans   []int    // compileSections で処理した各節の長さ
+	changes []change // Conductor に出力するテンポ・拍子の変更
+	bounds  []int    // 各セルの開始オフセット。nil なら小節の長さを数えない
+	bars    []bar
+	cur     int   // 直前に音長を数えたセル
+	fill    []int // 各セルを休符で埋める長さ (tick)。nil なら埋めない
+	in      int   // 処理中のセル。-1 ならセルの外
+	inStart int   // 処理中のセルに入った tick
+	last    int   // 最後に出たセル
+	parts   []int // Arrangement で並べた各節の最初のセルの添字。nil なら1つの節
+	tick    int
+	tuplets [][]int     // 連符の各音に割り当てた tick
+	offs    map[int]int // 音 (チャンネルと音番号) ごとの最後のノートオフの tick
+	seq     Sequence
+	errs    mml.ErrorList // 構文は正しいが演奏できないもの
+}
+
+func toEvents(nodes []mml.Node, ch, div int) Sequence {
+	return newCompiler(ch, div).compile(nodes)
+}
+
+func newCompiler(ch, div int) *compiler {
+	return &compiler{
+		ch:      ch,
+		div:     div,
+		oct:     4,
+		vel:     100,
+		defTick: lenToTick(div, 8),
+		gate:    8,
+		key:     keyAccidentals(0),
+		meter:   timeSignature{num: 4, den: 4},
+		tempo:   120,
+		bend:    2,
+		steps:   16,
+		lfos:    map[string]*lfo{},
+		lfoStep: clamp(div/16, 1, div),
+		ccs:     map[int]int{7: 100, 10: 64, 11: 127},
+		velStep: 8,
+		accent:  20,
+		swing:   swing{percent: 50, unit: 8},
+		loop:    -1,
+		offs:    map[int]int{},
+		cur:     -1,
+		in:      -1,
+		last:    -1,
+		seq:     Sequence{Events: []Event{}},
+	}
+}
+
+func (c *compiler) compile(nodes []mml.Node) Sequence {
+	return c.compileSections([][]mml.Node{nodes}, nil)
+}
+
+// compileSections は節ごとに構文木を処理し、節が lengths より短ければ休符で埋める
+func (c *compiler) compileSections(parts [][]mml.Node, lengths []int) Sequence {
+	if c.bars == nil && len(c.bounds) > 0 {
+		c.bars = make([]bar, len(c.bounds))
+	}
+	for j, nodes := range parts {
+		start := c.tick
+		first, end := c.partCells(j)
+		c.last = first - 1
+		for _, n := range mml.Expand(nodes) {
+			c.enter(c.cell(n.Pos()))
+			c.node(n)
+		}
+		c.enter(-1)
+		c.skip(end)
+		c.spans = append(c.spans, c.tick-start)
+		if j < len(lengths) && c.tick-start < lengths[j] {
+			c.tick = start + lengths[j]
+		}
+	}
+	c.seq.End = c.tick
+	return c.seq
+}
+
+// add はスウィングを適用してイベントを追加する
+// 揺らぎで同じ音の前のノートオフより早く発音しないよう、その音のイベントを後ろにずらす
+func (c *compiler) add(e ...Event) {
+	shift := map[int]int{} // 後ろにずらした音 (チャンネルと音番号) と tick
+	for i := range e {
+		e[i].Tick = c.swung(e[i].Tick)
+		if e[i].Kind != NoteOn && e[i].Kind != NoteOff {
+			continue
+		}
+		k := e[i].Channel<<8 | int(e[i].Data[0])
+		if e[i].Kind == NoteOn {
+			if off, ok := c.offs[k]; ok && e[i].Tick < off {
+				shift[k] = off - e[i].Tick
 			}
-			events = append(events, cc(0, ch, 10, v)...)
-		} else if s == "t" { // tempo
-			v, l := num(mml[i+1:], 1, 960)
-			if l > 0 {
-				i = i + l
+		}
+		e[i].Tick += shift[k]
+		if e[i].Kind == NoteOff {
+			c.offs[k] = e[i].Tick
+		}
+	}
+	c.seq.Events = append(c.seq.Events, e...)
+}
+
+func (c *compiler) node(n mml.Node) {
+	switch n := n.(type) {
+	case *mml.Note:
+		tick := c.take(c.duration(n.Length, n.Ties))
+		c.measureDurations(n.Length, n.Ties)
+		num := c.pitch(c.oct, n)
+		c.add(noteOnOff(c.onset(n.At), c.ch, num, c.velocity(n.Accent), c.gated(tick))...)
+		if len(n.Slide) > 0 {
+			c.slide(num, n.Slide, tick)
+		}
+		c.modulate(c.gated(tick), len(n.Slide) > 0)
+		c.tick += tick
+	case *mml.NoteNumber:
+		tick := c.take(c.duration(n.Length, n.Ties))
+		c.measureDurations(n.Length, n.Ties)
+		c.add(noteOnOff(c.onset(n.At), c.ch, n.Value, c.velocity(n.Accent), c.gated(tick))...)
+		c.modulate(c.gated(tick), false)
+		c.tick += tick
+	case *mml.Rest:
+		c.tick += c.take(c.duration(n.Length, n.Ties))
+		c.measureDurations(n.Length, n.Ties)
+	case *mml.Drum:
+		tick := c.take(c.duration(n.Length, n.Ties))
+		c.measureDurations(n.Length, n.Ties)
+		if num, ok := c.drum(n); ok {
+			c.add(noteOnOff(c.onset(n.At), c.ch, num, c.velocity(n.Accent), c.gated(tick))...)
+		}
+		c.tick += tick
+	case *mml.Chord:
+		notes := []note{}
+		o := c.oct
+		for _, cn := range n.Body {
+			switch cn := cn.(type) {
+			case *mml.Note:
+				notes = append(notes, note{num: c.pitch(o, cn), vel: c.velocity(n.Accent || cn.Accent)})
+			case *mml.NoteNumber:
+				notes = append(notes, note{num: cn.Value, vel: c.velocity(n.Accent || cn.Accent)})
+			case *mml.Drum:
+				if num, ok := c.drum(cn); ok {
+					notes = append(notes, note{num: num, vel: c.velocity(n.Accent || cn.Accent)})
+				}
+			case *mml.OctaveChange:
+				o += cn.Value
 			}
-			events = append(events, buildTempo(v)...)
-		} else if s == "v" { // velocity
-			v, l := num(mml[i+1:], 0, 127)
-			if l > 0 {
-				i = i + l
-				vel = v
+		}
+		tick := c.take(c.duration(n.Length, n.Ties))
+		c.measureDurations(n.Length, n.Ties)
+		c.add(notesOnOff(c.onset(n.At), c.ch, notes, c.gated(tick))...)
+		c.modulate(c.gated(tick), false)
+		c.tick += tick
+	case *mml.Tuplet:
+		tick := c.take(c.nominal(n))
+		c.measure(n.Length.At, tick)
+		c.tuplets = append(c.tuplets, distribute(tick, c.nominals(n.Body)))
+		for _, b := range n.Body {
+			c.node(b)
+		}
+		c.tuplets = c.tuplets[:len(c.tuplets)-1]
+	case *mml.OctaveChange:
+		if n.Relative {
+			c.oct += n.Value
+		} else {
+			c.oct = clamp(n.Value, 1, 8)
+		}
+	case *mml.Transpose:
+		if n.Relative {
+			c.shift += n.Value
+		} else {
+			c.shift = n.Value
+		}
+	case *mml.KeySignature:
+		c.key = keyAccidentals(clamp(n.Value, -7, 7))
+	case *mml.TimeSignature:
+		c.meter = timeSignature{num: n.Num, den: n.Den}
+		c.changes = append(c.changes, change{pos: n.At, desc: "time signature " + c.meter.String(), event: c.meter.event(c.tick)})
+	case *mml.Length:
+		c.defTick = c.ticks(mml.Duration{Value: n.Value, Ticks: n.Ticks})
+	case *mml.Program:
+		c.add(programChange(c.tick, c.ch, clamp(n.Value, 1, 128), n.MSB, n.LSB)...)
+	case *mml.Pan:
+		c.setCC(c.tick, 10, clamp(n.Value, 0, 127))
+	case *mml.ControlChange:
+		v := clamp(n.Value, 0, 127)
+		if n.Command == "@s" && v > 0 { // ペダルは踏むか離すか
+			v = 127
+		}
+		num := clamp(n.Number, 0, 127)
+		if !n.Ramp {
+			c.setCC(c.tick, num, v)
+			break
+		}
+		from, ok := c.ccs[num]
+		if !ok {
+			from = v
+		}
+		tick := c.tick
+		ramp(from, v, c.duration(n.Length, nil), c.lfoStep, func(offset, v int) {
+			c.setCC(tick+offset, num, v)
+		})
+	case *mml.PitchBend:
+		c.pb = clamp(n.Value, -8192, 8191)
+		c.add(pitchBend(c.tick, c.ch, c.pb))
+	case *mml.LFO:
+		c.lfos[n.Kind] = &lfo{
+			delay: clamp(n.Delay, 0, math.MaxInt32),
+			rate:  clamp(n.Rate, 1, math.MaxInt32),
+			depth: n.Depth,
+			wave:  clamp(n.Wave, 0, 3),
+			on:    true,
+		}
+	case *mml.LFOSwitch:
+		if l, ok := c.lfos[n.Kind]; ok {
+			l.on = n.On
+		}
+	case *mml.BendRange:
+		c.bend = clamp(n.Value, 1, 24)
+		c.add(bendRange(c.tick, c.ch, c.bend)...)
+	case *mml.SlideSteps:
+		c.steps = clamp(n.Value, 1, 128)
+	case *mml.Tempo:
+		to := clamp(n.Value, 1, 960)
+		if !n.Ramp {
+			c.setTempo(n.At, c.tick, to)
+			break
+		}
+		// 16分音符ごとに段階的に変える
+		tick := c.tick
+		ramp(c.tempo, to, c.duration(n.Length, nil), clamp(c.div/4, 1, c.div), func(offset, v int) {
+			c.setTempo(n.At, tick+offset, v)
+		})
+	case *mml.Gate:
+		if n.Ticks {
+			c.cut = clamp(n.Value, 0, c.div*4)
+		} else {
+			c.gate = clamp(n.Value, 1, 8)
+		}
+	case *mml.Velocity:
+		c.velRamp = nil
+		if !n.Ramp {
+			c.vel = clamp(n.Value, 0, 127)
+			break
+		}
+		length := c.duration(n.Length, nil)
+		if length > 0 {
+			c.velRamp = &velRamp{from: c.vel, start: c.tick, length: length}
+		}
+		c.vel = clamp(n.Value, 0, 127)
+	case *mml.VelocityStep:
+		c.velRamp = nil
+		c.vel = clamp(c.vel+n.Value*c.velStep, 0, 127)
+	case *mml.Swing:
+		c.swing = swing{percent: clamp(n.Percent, 1, 99), unit: 8}
+		if n.Unit > 0 {
+			c.swing.unit = clamp(n.Unit, 1, c.div)
+		}
+	case *mml.VelocityStepSize:
+		c.velStep = clamp(n.Value, 0, 127)
+	case *mml.Accent:
+		c.accent = clamp(n.Value, 0, 127)
+	case *mml.SysEx:
+		c.add(sysEx(c.tick, n.Data))
+	case *mml.LoopPoint:
+		if c.loop >= 0 {
+			c.errorf(n.At, "duplicate loop point")
+			return
+		}
+		c.loop, c.loopAt = c.tick, n.At
+		c.add(cc(c.tick, c.ch, 111, 0)) // CC#111(RPG ツクールのループ位置)
+	case *mml.Marker:
+		c.changes = append(c.changes, change{pos: n.At, desc: fmt.Sprintf("marker %q", n.Text), event: Event{Tick: c.tick, Kind: Marker, Data: []byte(n.Text)}})
+	case *mml.Channel:
+		c.ch = clamp(n.Value, 1, 16) - 1
+	}
+}
+
+// slide は音符 num から & の行き先まで tick の間に段階的にベンドし、最後に @b のベンドに戻す
+// 行き先がベンド幅を超える場合はベンド幅までにする
+func (c *compiler) slide(num int, nodes []mml.Node, tick int) {
+	o := c.oct
+	to := num
+	for _, n := range nodes {
+		switch n := n.(type) {
+		case *mml.OctaveChange:
+			o += n.Value
+		case *mml.Note:
+			to = c.pitch(o, n)
+		}
+	}
+	for i := 0; i < c.steps; i++ {
+		v := c.pb + (to-num)*8192*(i+1)/c.steps/c.bend
+		c.add(pitchBend(c.tick+tick*i/c.steps, c.ch, clamp(v, -8192, 8191)))
+	}
+	c.add(pitchBend(c.tick+tick, c.ch, c.pb))
+}
+
+// lfo はソフトウェア LFO の設定
+type lfo struct {
+	delay int
+	rate  int
+	depth int
+	wave  int
+	on    bool
+}
+
+// at は揺らし始めてから tick 後の -1～1 の値を返す
+func (l *lfo) at(tick int) float64 {
+	p := float64(tick%l.rate) / float64(l.rate)
+	switch l.wave {
+	case 1: // 正弦波
+		return math.Sin(2 * math.Pi * p)
+	case 2: // 矩形波
+		if p < 0.5 {
+			return 1
+		}
+		return -1
+	case 3: // のこぎり波
+		if p < 0.5 {
+			return 2 * p
+		}
+		return 2*p - 2
+	}
+	// 三角波
+	if p < 0.25 {
+		return 4 * p
+	}
+	if p < 0.75 {
+		return 2 - 4*p
+	}
+	return 4*p - 4
+}
+
+// modulate は有効な LFO で発音中の length の間の揺れをイベントにする
+// lfoStep ごとに値を求め、値が変わったときだけ出力する。最後に元の値に戻す
+func (c *compiler) modulate(length int, slide bool) {
+	for _, k := range []string{"v", "t", "p"} {
+		l, ok := c.lfos[k]
+		if !ok || !l.on || l.depth == 0 || k == "v" && slide {
+			continue
+		}
+		base := c.pb
+		switch k {
+		case "t":
+			base = c.ccs[11]
+		case "p":
+			base = c.ccs[10]
+		}
+		prev := base
+		for t := l.delay; t < length; t += c.lfoStep {
+			w := l.at(t - l.delay)
+			v := 0
+			switch k {
+			case "v":
+				v = clamp(base+int(math.Round(w*float64(l.depth))), -8192, 8191)
+			case "t": // 音量は下げる方向にだけ揺らす
+				v = clamp(base-int(math.Round((w+1)/2*float64(l.depth))), 0, 127)
+			case "p":
+				v = clamp(base+int(math.Round(w*float64(l.depth))), 0, 127)
 			}
-		} else if s == "$" { // channel
-			v, l := num(mml[i+1:], 1, 16)
-			if l > 0 {
-				i = i + l
-				ch = v - 1
+			if v != prev {
+				c.add(c.lfoEvent(k, c.tick+t, v))
+				prev = v
 			}
 		}
+		if prev != base {
+			c.add(c.lfoEvent(k, c.tick+length, base))
+		}
 	}
-	return events
 }
 
-func buildSMF(title string, events []byte, ch int) []byte {
-	body := []byte{}
-	body = append(body, buildTitle(title)...)              // Title
-	body = append(body, []byte{0x00, 0xFF, 0x20, 0x01}...) // Channel
-	body = append(body, itob(ch, 0)...)                    // Channel
-	body = append(body, []byte{0x00, 0xFF, 0x21, 0x01}...) // Port
-	body = append(body, itob(ch, 0)...)                    // Port
-	body = append(body, cc(0, ch, 121, 0)...)              // CC#121(Reset)
-	body = append(body, cc(0, ch, 7, 100)...)              // CC#7(Volume)
-	body = append(body, events...)
-	body = append(body, EOT...) //EOT
+// lfoEvent は LFO の種類に応じたイベントを返す
+func (c *compiler) lfoEvent(kind string, tick, v int) Event {
+	switch kind {
+	case "v":
+		return pitchBend(tick, c.ch, v)
+	case "t":
+		return cc(tick, c.ch, 11, v)
+	}
+	return cc(tick, c.ch, 10, v)
+}
 
-	smf := MTrk                               // "MTrk"
-	smf = append(smf, itofb(len(body), 4)...) // Length
-	smf = append(smf, body...)
-	return smf
+// setCC はコントロールチェンジを出力して値を覚えておく
+func (c *compiler) setCC(tick, num, v int) {
+	c.ccs[num] = v
+	c.add(cc(tick, c.ch, num, v))
+}
+
+// velRamp は v~ で段階的に変えている途中のベロシティ
+type velRamp struct {
+	from   int
+	start  int
+	length int
 }
 
-func num(s string, min, max int) (int, int) {
-	ss := ""
-	for _, v := range s {
-		j := string(v)
-		if j >= "0" && j <= "9" {
-			ss = ss + j
+// velocity は発音する音符のベロシティを返す
+func (c *compiler) velocity(accent bool) int {
+	v := c.vel
+	if r := c.velRamp; r != nil {
+		if c.tick < r.start+r.length {
+			v = r.from + (c.vel-r.from)*(c.tick-r.start)/r.length
 		} else {
-			break
+			c.velRamp = nil
 		}
 	}
-	n, err := strconv.Atoi(ss)
-	if err != nil {
-		return 0, 0
+	if accent {
+		v += c.accent
+	}
+	if c.rnd != nil && c.human.vel > 0 {
+		v += c.rnd.Intn(c.human.vel*2+1) - c.human.vel
+	}
+	return clamp(v, 0, 127)
+}
+
+// swing はスウィングの設定。percent が 50 ならスウィングしない
+type swing struct {
+	percent int // 裏拍の位置 (2拍分に対する %)
+	unit    int // 音長 (8 なら8分音符の裏拍を遅らせる)
+}
+
+// humanize は発音タイミングとベロシティを揺らす幅
+type humanize struct {
+	tick int
+	vel  int
+}
+
+// swung はスウィングを適用した tick を返す
+// unit の2つ分を区切りとして、裏拍が percent の位置に来るように区切りの中の時間を伸び縮みさせる
+func (c *compiler) swung(tick int) int {
+	if c.swing.percent == 50 || c.swing.unit == 0 {
+		return tick
+	}
+	u := lenToTick(c.div, c.swing.unit)
+	if u == 0 {
+		return tick
+	}
+	s := 2 * u * c.swing.percent / 100
+	base, p := tick-tick%(2*u), tick%(2*u)
+	if p <= u {
+		return base + p*s/u
+	}
+	return base + s + (p-u)*(2*u-s)/u
+}
+
+// jitter は human.tick の範囲で揺らした発音タイミングを返す
+func (c *compiler) jitter() int {
+	if c.rnd == nil || c.human.tick == 0 {
+		return c.tick
+	}
+	return clamp(c.tick+c.rnd.Intn(c.human.tick*2+1)-c.human.tick, 0, math.MaxInt32)
+}
+
+// onset は発音の tick を返し、pos のセルに歌詞が残っていれば次の1つを同じ位置に出力する
+// 歌詞が "-" なら出力せずに次の音へ進む
+func (c *compiler) onset(pos mml.Pos) int {
+	tick := c.jitter()
+	k := c.cell(pos)
+	if len(c.lyrics[k]) == 0 {
+		return tick
+	}
+	if s := c.lyrics[k][0]; s != "-" {
+		c.add(Event{Tick: tick, Kind: Lyric, Data: []byte(s)})
+	}
+	c.lyrics[k] = c.lyrics[k][1:]
+	return tick
+}
+
+// ramp は length の間に step ごとに from から to まで値を変え、値が変わるたびに f を呼ぶ
+func ramp(from, to, length, step int, f func(offset, v int)) {
+	steps := length / step
+	if steps < 1 {
+		steps = 1
+	}
+	prev := from
+	for i := 1; i <= steps; i++ {
+		v := from + (to-from)*i/steps
+		if v != prev {
+			f(length*(i-1)/steps, v)
+			prev = v
+		}
 	}
+}
+
+// setTempo はテンポの変更を記録する
+func (c *compiler) setTempo(pos mml.Pos, tick, tempo int) {
+	c.tempo = tempo
+	c.changes = append(c.changes, change{pos: pos, desc: fmt.Sprintf("tempo %d", tempo), event: buildTempo(tick, tempo)})
+}
+
+// measure は tick を pos のセルの長さに加える。連符の中は連符全体で数える
+func (c *compiler) measure(pos mml.Pos, tick int) {
+	if len(c.bounds) == 0 || len(c.tuplets) > 0 {
+		return
+	}
+	if c.bars == nil {
+		c.bars = make([]bar, len(c.bounds))
+	}
+	c.count(c.cell(pos), tick)
+}
+
+// count は tick をセル k の長さに加える
+func (c *compiler) count(k, tick int) {
+	if k != c.cur {
+		if c.bars[k].passes == 0 {
+			c.bars[k].meter = c.meter
+		}
+		c.bars[k].passes++
+		c.cur = k
+	}
+	c.bars[k].ticks += tick
+}
+
+// enter はセル k に入る。直前のセルが fill より短ければ休符で埋める。k が -1 ならセルを出る
+// 間に一度も処理していないセルがあれば、そのセルも埋める
+func (c *compiler) enter(k int) {
+	if k == c.in {
+		return
+	}
+	if c.in >= 0 {
+		c.pad(c.in, c.tick-c.inStart)
+		c.last = c.in
+	}
+	c.skip(k)
+	c.in, c.inStart = k, c.tick
+	if k >= 0 {
+		c.visit(k)
+	}
+}
+
+// visit はセル k を処理したことと、そのときの拍子を記録する
+func (c *compiler) visit(k int) {
+	if k < len(c.bars) && !c.bars[k].seen {
+		c.bars[k].seen, c.bars[k].meter = true, c.meter
+	}
+}
+
+// skip は最後に出たセルから k の手前までの、一度も処理していないセルを埋める
+// 繰り返しで戻るときや、一度処理したセルを飛ばすときは何もしない
+func (c *compiler) skip(k int) {
+	for j := c.last + 1; j < k && j < len(c.bars); j++ {
+		if c.bars[j].seen {
+			continue
+		}
+		c.visit(j)
+		if c.bars[j].passes == 0 { // タイで長さを数えたセルは埋めない
+			c.pad(j, 0)
+		}
+		c.last = j
+	}
+}
+
+// pad は elapsed tick 進んだセル k が fill より短ければ休符で埋める
+func (c *compiler) pad(k, elapsed int) {
+	if k >= len(c.fill) || k >= len(c.bars) {
+		return
+	}
+	if pad := c.fill[k] - elapsed; pad > 0 {
+		c.tick += pad
+		c.count(k, pad)
+	}
+}
+
+// partCells は節 j の最初のセルと、次の節の最初のセルの添字を返す
+func (c *compiler) partCells(j int) (int, int) {
+	if c.parts == nil {
+		return 0, len(c.bounds)
+	}
+	first, end := len(c.bounds), len(c.bounds)
+	if j < len(c.parts) {
+		first = c.parts[j]
+	}
+	if j+1 < len(c.parts) {
+		end = c.parts[j+1]
+	}
+	return first, end
+}
+
+// cell は pos を含むセルの添字を返す
+func (c *compiler) cell(pos mml.Pos) int {
+	k := sort.SearchInts(c.bounds, int(pos)+1) - 1
+	if k < 0 {
+		k = 0
+	}
+	return k
+}
+
+// measureDurations は音長とタイをそれぞれ書かれたセルの長さに加える
+func (c *compiler) measureDurations(d mml.Duration, ties []mml.Duration) {
+	c.measure(d.At, c.durationFrom(c.defTick, d, nil))
+	for _, t := range ties {
+		c.measure(t.At, c.durationFrom(c.defTick, t, nil))
+	}
+}
+
+// duration は音長とタイから tick を求める
+func (c *compiler) duration(d mml.Duration, ties []mml.Duration) int {
+	return c.durationFrom(c.defTick, d, ties)
+}
+
+// durationFrom は音長省略時を def として音長とタイから tick を求める
+func (c *compiler) durationFrom(def int, d mml.Duration, ties []mml.Duration) int {
+	tick := def
+	if !d.Omitted() {
+		tick = c.ticks(d)
+	}
+	if d.Dot {
+		tick = int(float64(tick) * 1.5)
+	}
+	for _, t := range ties {
+		tick2 := c.defTick
+		if !t.Omitted() {
+			tick2 = c.ticks(t)
+		}
+		if t.Dot {
+			tick2 = int(float64(tick2) * 1.5)
+		}
+		tick += tick2
+	}
+	return tick
+}
+
+// ticks は付点を除いた音長を tick にする
+func (c *compiler) ticks(d mml.Duration) int {
+	if d.Ticks {
+		return clamp(d.Value, 1, math.MaxInt32)
+	}
+	return lenToTick(c.div, clamp(d.Value, 1, c.div))
+}
+
+// nominal は連符の長さを求める。音長省略時は中身の長さから求める
+func (c *compiler) nominal(n *mml.Tuplet) int {
+	def := 0
+	if n.Length.Omitted() {
+		for _, t := range c.nominals(n.Body) {
+			def += t
+		}
+		def = def * n.Base() / n.Count
+	}
+	return c.durationFrom(def, n.Length, n.Ties)
+}
+
+// nominals は連符の中の音符・休符・和音・連符それぞれの本来の長さを返す
+// 長さを求めるだけなので、音長 (l) 以外のコマンドは処理しない
+func (c *compiler) nominals(body []mml.Node) []int {
+	m := *c
+	m.seq = Sequence{}
+	m.tuplets = nil
+	ret := []int{}
+	for _, b := range body {
+		switch b := b.(type) {
+		case *mml.Note:
+			ret = append(ret, m.duration(b.Length, b.Ties))
+		case *mml.Rest:
+			ret = append(ret, m.duration(b.Length, b.Ties))
+		case *mml.NoteNumber:
+			ret = append(ret, m.duration(b.Length, b.Ties))
+		case *mml.Drum:
+			ret = append(ret, m.duration(b.Length, b.Ties))
+		case *mml.Chord:
+			ret = append(ret, m.duration(b.Length, b.Ties))
+		case *mml.Tuplet:
+			ret = append(ret, m.nominal(b))
+		case *mml.Length:
+			m.node(b)
+		}
+	}
+	return ret
+}
+
+// take は連符の中なら割り当て済みの tick を、そうでなければ tick をそのまま返す
+func (c *compiler) take(tick int) int {
+	if len(c.tuplets) == 0 {
+		return tick
+	}
+	q := c.tuplets[len(c.tuplets)-1]
+	if len(q) == 0 {
+		return tick
+	}
+	c.tuplets[len(c.tuplets)-1] = q[1:]
+	return q[0]
+}
+
+// distribute は total を weights の比で端数なく分配する
+func distribute(total int, weights []int) []int {
+	sum := 0
+	for _, w := range weights {
+		sum += w
+	}
+	ret := []int{}
+	prev, acc := 0, 0
+	for _, w := range weights {
+		acc += w
+		next := 0
+		if sum > 0 {
+			next = total * acc / sum
+		}
+		ret = append(ret, next-prev)
+		prev = next
+	}
+	return ret
+}
+
+// gated はゲートタイムを適用した発音の長さを返す。最短は1tick
+func (c *compiler) gated(tick int) int {
+	return clamp(tick*c.gate/8-c.cut, 1, tick)
+}
+
+// pitch は調号と移調を適用したノート番号を返す。ドラム(10ch)には Transpose を適用しない
+func (c *compiler) pitch(oct int, n *mml.Note) int {
+	num := noteNum(oct, n.Key) + n.Accidental + c.shift
+	if c.ch != 9 { // ドラムの音名を音階で書いたときは調号も移調も適用しない
+		if n.Accidental == 0 && !n.Natural {
+			num += c.key[n.Key]
+		}
+		num += c.global
+	}
+	if num < 0 || num > 127 {
+		c.errorf(n.At, "note number %d out of range", num)
+	}
+	return clamp(num, 0, 127)
+}
+
+// gmDrums は GM のドラムの音名と音番号
+var gmDrums = map[string]int{
+	"abd":    35, // Acoustic Bass Drum
+	"bd":     36, // Bass Drum 1
+	"kick":   36,
+	"rim":    37, // Side Stick
+	"sd":     38, // Acoustic Snare
+	"snare":  38,
+	"clap":   39, // Hand Clap
+	"esd":    40, // Electric Snare
+	"lft":    41, // Low Floor Tom
+	"hh":     42, // Closed Hi-Hat
+	"hft":    43, // High Floor Tom
+	"ph":     44, // Pedal Hi-Hat
+	"lt":     45, // Low Tom
+	"oh":     46, // Open Hi-Hat
+	"lmt":    47, // Low-Mid Tom
+	"hmt":    48, // Hi-Mid Tom
+	"crash":  49, // Crash Cymbal 1
+	"ht":     50, // High Tom
+	"ride":   51, // Ride Cymbal 1
+	"china":  52, // Chinese Cymbal
+	"bell":   53, // Ride Bell
+	"tamb":   54, // Tambourine
+	"splash": 55, // Splash Cymbal
+	"cow":    56, // Cowbell
+	"crashb": 57, // Crash Cymbal 2
+	"vibra":  58, // Vibraslap
+	"rideb":  59, // Ride Cymbal 2
+	"hbongo": 60, // Hi Bongo
+	"lbongo": 61, // Low Bongo
+	"mconga": 62, // Mute Hi Conga
+	"hconga": 63, // Open Hi Conga
+	"lconga": 64, // Low Conga
+	"htimb":  65, // High Timbale
+	"ltimb":  66, // Low Timbale
+	"hagogo": 67, // High Agogo
+	"lagogo": 68, // Low Agogo
+	"cabasa": 69, // Cabasa
+	"maraca": 70, // Maracas
+	"swhis":  71, // Short Whistle
+	"lwhis":  72, // Long Whistle
+	"sguiro": 73, // Short Guiro
+	"lguiro": 74, // Long Guiro
+	"claves": 75, // Claves
+	"hwood":  76, // Hi Wood Block
+	"lwood":  77, // Low Wood Block
+	"mcuica": 78, // Mute Cuica
+	"ocuica": 79, // Open Cuica
+	"mtri":   80, // Mute Triangle
+	"otri":   81, // Open Triangle
+}
+
+// drum はドラムの音名を音番号にする。10ch 以外や未知の音名ならエラーにして false を返す
+func (c *compiler) drum(n *mml.Drum) (int, bool) {
+	if c.ch != 9 {
+		c.errorf(n.At, "drum %q outside channel 10", n.Name)
+		return 0, false
+	}
+	if v, ok := c.drums[n.Name]; ok {
+		return v, true
+	}
+	if v, ok := gmDrums[n.Name]; ok {
+		return v, true
+	}
+	c.errorf(n.At, "unknown drum %q", n.Name)
+	return 0, false
+}
+
+// errorf はエラーを記録する。繰り返しで同じ位置を何度も通っても1つにまとめる
+func (c *compiler) errorf(pos mml.Pos, format string, a ...interface{}) {
+	msg := fmt.Sprintf(format, a...)
+	for _, e := range c.errs {
+		if e.Pos == pos && e.Msg == msg {
+			return
+		}
+	}
+	c.errs = append(c.errs, &mml.Error{Pos: pos, Msg: msg})
+}
+
+// keyAccidentals は調号 sf (正ならシャープ、負ならフラットの数) で変化する音名と変化量を返す
+func keyAccidentals(sf int) map[string]int {
+	ret := map[string]int{}
+	for i := 0; i < sf; i++ {
+		ret[string("fcgdaeb"[i])] = 1
+	}
+	for i := 0; i < -sf; i++ {
+		ret[string("beadgcf"[i])] = -1
+	}
+	return ret
+}
+
+// buildSMF はパートのトラックを作る。start はチャンネルを初期化する tick
+func buildSMF(title string, seq Sequence, ch, start int) []byte {
+	events := []Event{
+		buildTitle(title),                        // Title
+		{Kind: ChannelPrefix, Data: itob(ch, 0)}, // Channel
+		{Kind: Port, Data: itob(ch, 0)},          // Port
+		cc(start, ch, 121, 0),                    // CC#121(Reset)
+		cc(start, ch, 7, 100),                    // CC#7(Volume)
+	}
+	events = append(events, seq.Events...)
+	return trackChunk(Sequence{Events: events, End: seq.End}.Encode())
+}
+
+// trackChunk はトラックデータに MTrk ヘッダを付ける
+func trackChunk(body []byte) []byte {
+	smf := MTrk                               // "MTrk"
+	smf = append(smf, itofb(len(body), 4)...) // Length
+	smf = append(smf, body...)
+	return smf
+}
+
+func clamp(n, min, max int) int {
 	if n < min {
 		n = min
 	}
 	if n > max {
 		n = max
 	}
-	return n, len(ss)
+	return n
 }
 
-func noteOnOff(ch int, oct int, note string, vel int, tick int) []byte {
-	ret := []byte{}
-	if note == "r" {
-		// 無音を再生
-		ret = append(ret, event(0, 0x90+ch, 0, 0)...)    // on
-		ret = append(ret, event(tick, 0x80+ch, 0, 0)...) // off
-		return ret
+func noteOnOff(tick, ch, n, vel, length int) []Event {
+	return []Event{
+		event(tick, ch, NoteOn, n, vel),       // on
+		event(tick+length, ch, NoteOff, n, 0), // off
 	}
-	n := noteNum(oct, note)
-	ret = append(ret, event(0, 0x90+ch, n, vel)...)  // on
-	ret = append(ret, event(tick, 0x80+ch, n, 0)...) // off
-	return ret
 }
 
-func notesOnOff(ch int, notes []note, tick int) []byte {
-	ret := []byte{}
+func notesOnOff(tick, ch int, notes []note, length int) []Event {
+	ret := []Event{}
 	for _, n := range notes {
-		ret = append(ret, event(0, 0x90+ch, n.num, n.vel)...) // on
+		ret = append(ret, event(tick, ch, NoteOn, n.num, n.vel)) // on
 	}
-	for i, n := range notes {
-		if i == 0 {
-			ret = append(ret, event(tick, 0x80+ch, n.num, 0)...) // off
-		} else {
-			ret = append(ret, event(0, 0x80+ch, n.num, 0)...) // off
-		}
+	for _, n := range notes {
+		ret = append(ret, event(tick+length, ch, NoteOff, n.num, 0)) // off
 	}
 	return ret
 }
@@ -427,32 +1967,63 @@ func noteNum(oct int, note string) int {
 	return (oct+1)*12 + val
 }
 
-func event(dt, ev, n, vel int) []byte {
-	ret := []byte{}
-	ret = append(ret, itob(dt, 0)...)
-	ret = append(ret, itofb(ev, 1)...)
-	ret = append(ret, itofb(n, 1)...)
-	ret = append(ret, itofb(vel, 1)...)
-	return ret
+func event(tick, ch int, kind EventKind, data ...int) Event {
+	e := Event{Tick: tick, Channel: ch, Kind: kind, Data: []byte{}}
+	for _, d := range data {
+		e.Data = append(e.Data, itofb(d, 1)...)
+	}
+	return e
 }
 
-func programChange(ch int, p int) []byte {
-	ret := []byte{}
-	ret = append(ret, cc(0, ch, 0, 0)...)  // CC#0(MSB)
-	ret = append(ret, cc(0, ch, 32, 0)...) // CC#32(LSB)
-	ret = append(ret, []byte{0x00}...)
-	ret = append(ret, itofb(0xC0+ch, 1)...)
-	ret = append(ret, itob(p-1, 0)...)
-	return ret
+func programChange(tick, ch, p, msb, lsb int) []Event {
+	return []Event{
+		cc(tick, ch, 0, msb),  // CC#0(MSB)
+		cc(tick, ch, 32, lsb), // CC#32(LSB)
+		event(tick, ch, ProgramChange, p-1),
+	}
 }
 
-func cc(dt, ch, num, val int) []byte {
-	ret := []byte{}
-	ret = append(ret, itob(dt, 0)...)
-	ret = append(ret, itofb(0xB0+ch, 1)...)
-	ret = append(ret, itofb(num, 1)...)
-	ret = append(ret, itofb(val, 1)...)
-	return ret
+// sysEx は F0 と F7 を除いた内容 data のシステムエクスクルーシブを返す
+func sysEx(tick int, data []byte) Event {
+	return Event{Tick: tick, Kind: SysEx, Data: append(append([]byte{}, data...), 0xF7)}
+}
+
+// resetDelay はリセットの後、音源が次のメッセージを受け付けるまで待つ時間 (ms)
+const resetDelay = 100
+
+// resetWait は Reset を指定したとき、パートの最初のイベントまで空ける tick を返す。最初のテンポで resetDelay 以上にする
+func (mm *MDMML) resetWait() int {
+	if mm.reset == "" {
+		return 0
+	}
+	return (mm.divisions*mm.tempo*resetDelay + 59999) / 60000
+}
+
+// resets は Front Matter の Reset で Conductor の先頭に出力するリセットのシステムエクスクルーシブ
+var resets = map[string][]byte{
+	"GM": {0x7E, 0x7F, 0x09, 0x01},
+	"GS": {0x41, 0x10, 0x42, 0x12, 0x40, 0x00, 0x7F, 0x00, 0x41},
+	"XG": {0x43, 0x10, 0x4C, 0x00, 0x00, 0x7E, 0x00},
+}
+
+// pitchBend は -8192～8191 のピッチベンドを返す
+func pitchBend(tick, ch, v int) Event {
+	v += 8192
+	return event(tick, ch, PitchBend, v&0x7f, v>>7)
+}
+
+// bendRange は RPN 0,0 でベンド幅を設定する
+func bendRange(tick, ch, semitones int) []Event {
+	return []Event{
+		cc(tick, ch, 101, 0),       // RPN MSB
+		cc(tick, ch, 100, 0),       // RPN LSB
+		cc(tick, ch, 6, semitones), // Data Entry MSB
+		cc(tick, ch, 38, 0),        // Data Entry LSB
+	}
+}
+
+func cc(tick, ch, num, val int) Event {
+	return event(tick, ch, ControlChange, num, val)
 }
 
 // itob は int を f 桁の可変長バイナリにして返す
@@ -577,15 +2148,10 @@ func atoi(a string, def int) int {
 	return ret
 }
 
-func buildTitle(title string) []byte {
-	ret := []byte{0x00, 0xff, 0x03}
-	ret = append(ret, itofb(len(title), 1)...)
-	ret = append(ret, []byte(title)...)
-	return ret
+func buildTitle(title string) Event {
+	return Event{Kind: TrackName, Data: []byte(title)}
 }
 
-func buildTempo(tempo int) []byte {
-	ret := []byte{0x00, 0xff, 0x51, 0x03}
-	ret = append(ret, itofb(tempoMs(tempo), 3)...)
-	return ret
+func buildTempo(tick, tempo int) Event {
+	return Event{Tick: tick, Kind: SetTempo, Data: itofb(clamp(tempoMs(tempo), 0, 0xFFFFFF), 3)}
 }
@@ -1,10 +1,12 @@
 package mdmml
 
 import (
+	"math/rand"
 	"os"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/umemak/mdmml/mml"
 )
 
 func TestMDMML_SMF(t *testing.T) {
@@ -107,8 +109,10 @@ func TestMDtoMML(t *testing.T) {
 			title:     "テスト",
 			tempo:     120,
 			Tracks: []Track{
-				{name: "A", mmls: []string{"@10cdef", "gab>c", "c<bag", "fedc"}},
-				{name: "B", mmls: []string{"@20efga", "b>cde", "edc<b", "agfe"}},
+				{name: "A", mmls: []string{"@10cdef", "gab>c", "c<bag", "fedc"},
+					cells: []cell{{line: 8, column: 2}, {line: 8, column: 3}, {table: 1, line: 13, column: 2}, {table: 1, line: 13, column: 3}}},
+				{name: "B", mmls: []string{"@20efga", "b>cde", "edc<b", "agfe"},
+					cells: []cell{{line: 9, column: 2}, {line: 9, column: 3}, {table: 1, line: 14, column: 2}, {table: 1, line: 14, column: 3}}},
 			},
 		}},
 		{name: "colon in title", src: []byte("---\nTitle:te:st\n---\n"), want: &MDMML{divisions: 960, title: "te:st", tempo: 120}},
@@ -116,6 +120,58 @@ func TestMDtoMML(t *testing.T) {
 		{name: "divisions error", src: []byte("---\nDivisions:AAA\n---\n"), want: &MDMML{divisions: 960, tempo: 120}},
 		{name: "tempo", src: []byte("---\nTempo:200\n---\n"), want: &MDMML{divisions: 960, tempo: 200}},
 		{name: "tempo error", src: []byte("---\nTempo:AAA\n---\n"), want: &MDMML{divisions: 960, tempo: 120}},
+		{name: "unterminated", src: []byte("---\nTempo:200\n"), want: &MDMML{divisions: 960, tempo: 200}},
+		{name: "drum grid", src: []byte("| name | 1 | 2 |\n|---|---|---|\n| DR:hh | x.x. | xxxx |\n| DR:BD | X... | x |\n"), want: &MDMML{
+			divisions: 960,
+			tempo:     120,
+			Tracks: []Track{
+				{name: "DR", mmls: []string{"$10{*hh*bd'}%1920{*hh}%1920", "{*hh*bd}%960{*hh}%960{*hh}%960{*hh}%960"},
+					cells: []cell{{line: 3, column: 2}, {line: 3, column: 3}}},
+			},
+		}},
+		{name: "lyrics", src: []byte("| name | 1 | 2 |\n|---|---|---|\n| A | cde | fg |\n| A:lyric | ha - py | day |\n| B | c | d |\n| A | e | f |\n"), want: &MDMML{
+			divisions: 960,
+			tempo:     120,
+			Tracks: []Track{
+				{name: "A", mmls: []string{"cde", "fg", "e", "f"},
+					cells:  []cell{{line: 3, column: 2}, {line: 3, column: 3}, {line: 6, column: 2}, {line: 6, column: 3}},
+					lyrics: map[int][]string{0: {"ha", "-", "py"}, 1: {"day"}}},
+				{name: "B", mmls: []string{"c", "d"},
+					cells: []cell{{line: 5, column: 2}, {line: 5, column: 3}}},
+			},
+		}},
+		{name: "arrangement", src: []byte("---\nArrangement: V, C, V\n---\n## V\n| name | 1 |\n|---|---|\n| A | c |\n## C\n| name | 1 |\n|---|---|\n| B | d |\n"), want: &MDMML{
+			divisions: 960,
+			tempo:     120,
+			Tracks: []Track{
+				{name: "A", mmls: []string{"c", "c"}, cells: []cell{{line: 7, column: 2}, {line: 7, column: 2}}, sections: []int{0, 0, 1, 1}},
+				{name: "B", mmls: []string{"d"}, cells: []cell{{table: 1, line: 11, column: 2}}, sections: []int{0, 0, 0, 1}},
+			},
+		}},
+		{name: "arrangement table", src: []byte("| arrangement |\n|---|\n| V |\n| V |\n\n# V\n\n| name | 1 |\n|---|---|\n| A | c |\n"), want: &MDMML{
+			divisions: 960,
+			tempo:     120,
+			Tracks: []Track{
+				{name: "A", mmls: []string{"c", "c"}, cells: []cell{{table: 1, line: 10, column: 2}, {table: 1, line: 10, column: 2}}, sections: []int{0, 0, 1}},
+			},
+		}},
+		{name: "sections in document order", src: []byte("| name | 1 |\n|---|---|\n| A | c |\n\n## V\n| name | 1 |\n|---|---|\n| B | d |\n| A | e |\n"), want: &MDMML{
+			divisions: 960,
+			tempo:     120,
+			Tracks: []Track{
+				{name: "A", mmls: []string{"c", "e"}, cells: []cell{{line: 3, column: 2}, {table: 1, line: 9, column: 2}}},
+				{name: "B", mmls: []string{"d"}, cells: []cell{{table: 1, line: 8, column: 2}}},
+			},
+		}},
+		{name: "drum grid after mml", src: []byte("---\nTimeSignature: 3/4\n---\n| name | 1 |\n|---|---|\n| DR | $10 |\n| DR:sd | .. x |\n"), want: &MDMML{
+			divisions: 960,
+			tempo:     120,
+			meter:     &timeSignature{num: 3, den: 4},
+			Tracks: []Track{
+				{name: "DR", mmls: []string{"$10", "r%1920{*sd}%960"},
+					cells: []cell{{line: 6, column: 2}, {line: 7, column: 2}}},
+			},
+		}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -129,31 +185,325 @@ func TestMDtoMML(t *testing.T) {
 	}
 }
 
+func TestMDtoMMLWithError(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     []byte
+		want    *MDMML
+		wantErr string
+	}{
+		{name: "normal", src: []byte("---\nTempo: 200\n\n---\n"), want: &MDMML{divisions: 960, tempo: 200}},
+		{name: "divisions error", src: []byte("---\nDivisions:AAA\n---\n"), want: &MDMML{divisions: 960, tempo: 120},
+			wantErr: "test.md:2: invalid Divisions: AAA"},
+		{name: "tempo error", src: []byte("---\nTempo:0\n---\n"), want: &MDMML{divisions: 960, tempo: 120},
+			wantErr: "test.md:2: invalid Tempo: 0"},
+		{name: "invalid line", src: []byte("---\nTempo\n---\n"), want: &MDMML{divisions: 960, tempo: 120},
+			wantErr: "test.md:2: invalid front matter line"},
+		{name: "unterminated", src: []byte("\n---\nTempo:200\n"), want: &MDMML{divisions: 960, tempo: 200},
+			wantErr: "test.md:2: unterminated front matter"},
+		{name: "transpose and key", src: []byte("---\nTranspose: -2\nKey: F#m\n---\n"),
+			want: &MDMML{divisions: 960, tempo: 120, transpose: -2, key: &keySignature{sf: 3, minor: true}}},
+		{name: "transpose error", src: []byte("---\nTranspose: up\n---\n"), want: &MDMML{divisions: 960, tempo: 120},
+			wantErr: "test.md:2: invalid Transpose: up"},
+		{name: "key error", src: []byte("---\nKey: H\n---\n"), want: &MDMML{divisions: 960, tempo: 120},
+			wantErr: "test.md:2: invalid Key: H"},
+		{name: "time signature", src: []byte("---\nTimeSignature: 3/4\n---\n"),
+			want: &MDMML{divisions: 960, tempo: 120, meter: &timeSignature{num: 3, den: 4}}},
+		{name: "time signature error", src: []byte("---\nTimeSignature: 3/5\n---\n"), want: &MDMML{divisions: 960, tempo: 120},
+			wantErr: "test.md:2: invalid TimeSignature: 3/5"},
+		{name: "lfo interval", src: []byte("---\nLFOInterval: 30\n---\n"), want: &MDMML{divisions: 960, tempo: 120, lfoStep: 30}},
+		{name: "lfo interval error", src: []byte("---\nLFOInterval: 0\n---\n"), want: &MDMML{divisions: 960, tempo: 120},
+			wantErr: "test.md:2: invalid LFOInterval: 0"},
+		{name: "swing and humanize", src: []byte("---\nSwing: 60,16\nHumanize: 10, 4\nSeed: 42\n---\n"),
+			want: &MDMML{divisions: 960, tempo: 120, swing: swing{percent: 60, unit: 16}, human: humanize{tick: 10, vel: 4}, seed: 42}},
+		{name: "swing error", src: []byte("---\nSwing: 100\nHumanize: -1\nSeed: x\n---\n"), want: &MDMML{divisions: 960, tempo: 120},
+			wantErr: "test.md:2: invalid Swing: 100\ntest.md:3: invalid Humanize: -1\ntest.md:4: invalid Seed: x"},
+		{name: "drums", src: []byte("---\nDrums: kick=35, Tri=81\n---\n| drum | note |\n|---|---|\n| cb | 56 |\n| 9x | 1 |\n"),
+			want:    &MDMML{divisions: 960, tempo: 120, drums: map[string]int{"kick": 35, "tri": 81, "cb": 56}},
+			wantErr: "test.md:7: invalid drum map row: 9x"},
+		{name: "reset", src: []byte("---\nReset: gs\n---\n"), want: &MDMML{divisions: 960, tempo: 120, reset: "GS"}},
+		{name: "reset error", src: []byte("---\nReset: GX\n---\n"), want: &MDMML{divisions: 960, tempo: 120},
+			wantErr: "test.md:2: invalid Reset: GX"},
+		{name: "macros", src: []byte("| macro | mml |\n|---|---|\n| Riff | l8 cde |\n| 9x | c |\n"),
+			want:    &MDMML{divisions: 960, tempo: 120, macros: map[string]string{"riff": "l8 cde"}},
+			wantErr: "test.md:4: invalid macro row: 9x"},
+		{name: "auto pad", src: []byte("---\nAutoPad: true\n---\n"), want: &MDMML{divisions: 960, tempo: 120, autoPad: true}},
+		{name: "auto pad error", src: []byte("---\nAutoPad: maybe\n---\n"), want: &MDMML{divisions: 960, tempo: 120},
+			wantErr: "test.md:2: invalid AutoPad: maybe"},
+		{name: "composer and copyright", src: []byte("---\nComposer: C\nCopyright: (c) R\n---\n"), want: &MDMML{divisions: 960, tempo: 120, composer: "C", copyright: "(c) R"}},
+		{name: "lyric row error", src: []byte("| name | 1 |\n|---|---|\n| A:lyric | la |\n"), want: &MDMML{divisions: 960, tempo: 120},
+			wantErr: "test.md:3: lyric row without A row"},
+		{name: "unknown section", src: []byte("---\nArrangement: X\n---\n"), want: &MDMML{divisions: 960, tempo: 120},
+			wantErr: "test.md:2: unknown section \"X\""},
+		{name: "drums error", src: []byte("---\nDrums: kick=200\n---\n"), want: &MDMML{divisions: 960, tempo: 120},
+			wantErr: "test.md:2: invalid Drums: kick=200"},
+		{name: "drum grid unknown drum", src: []byte("| name | 1 |\n|---|---|\n| DR:bd | x... |\n| DR:zz | ..x. |\n"), want: &MDMML{divisions: 960, tempo: 120,
+			Tracks: []Track{{name: "DR", mmls: []string{"$10{*bd}%3840"}, cells: []cell{{file: "test.md", line: 3, column: 2}}}}},
+			wantErr: "test.md:4:1:0: DR: unknown drum \"zz\""},
+		{name: "drum grid error", src: []byte("| name | 1 |\n|---|---|\n| DR:bd | x.o. |\n"), want: &MDMML{divisions: 960, tempo: 120,
+			Tracks: []Track{{name: "DR", mmls: []string{"$10{*bd}%3840"}, cells: []cell{{file: "test.md", line: 3, column: 2}}}}},
+			wantErr: "test.md:3:2:2: DR: invalid grid step 'o'"},
+		{name: "include without loader", src: []byte("!include /etc/hosts\n"), want: &MDMML{divisions: 960, tempo: 120},
+			wantErr: "test.md:1: cannot include /etc/hosts: no loader"},
+		{name: "all errors", src: []byte("---\nTempo:0\nDivisions:0\n---\n"), want: &MDMML{divisions: 960, tempo: 120},
+			wantErr: "test.md:2: invalid Tempo: 0\ntest.md:3: invalid Divisions: 0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := MDtoMMLWithError("test.md", tt.src)
+			assert.Equal(t, tt.want, got)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMDtoMMLWithLoader(t *testing.T) {
+	files := map[string]string{
+		"lib/common.md": "---\nTempo: 140\n---\n\n| macro | mml |\n|---|---|\n| riff | cde |\n| 9x | c |\n",
+		"lib/drums.md":  "| name | 1 |\n|---|---|\n| DR | $10 *bd |\n",
+	}
+	load := func(name string) ([]byte, error) {
+		return []byte(files[name]), nil
+	}
+	src := "!include lib/common.md\n| name | 1 |\n|---|---|\n| A | !riff |\n\n!include lib/drums.md\n"
+	got, err := MDtoMMLWithLoader("song.md", []byte(src), load)
+	assert.Equal(t, &MDMML{divisions: 960, tempo: 140, macros: map[string]string{"riff": "cde"},
+		Tracks: []Track{
+			{name: "A", mmls: []string{"!riff"}, cells: []cell{{file: "song.md", table: 1, line: 4, column: 2}}},
+			{name: "DR", mmls: []string{"$10 *bd"}, cells: []cell{{file: "lib/drums.md", table: 2, line: 3, column: 2}}},
+		}}, got)
+	assert.EqualError(t, err, "lib/common.md:8: invalid macro row: 9x")
+}
+
+func TestMDMML_MMLtoSMFWithError(t *testing.T) {
+	table := "| name | 1 | 2 | 3 |\n|---|---|---|---|\n"
+	tests := []struct {
+		name    string
+		src     []byte
+		meters  []Event
+		tempos  []Event
+		texts   []Event
+		ends    []int
+		wantErr string
+	}{
+		{name: "arrangement", src: []byte("---\nArrangement: V, C, V\n---\n## V\n" + table + "| A | c1 |\n| B | c2 |\n## C\n" + table + "| B | m\"C\" d1 |\n"),
+			texts: []Event{{Tick: 3840, Kind: Marker, Data: []byte("C")}},
+			ends:  []int{11520, 11520}},
+		{name: "normal", src: []byte("| name | 1 | 2 |\n|---|---|---|\n| A | cde | fga |\n")},
+		{name: "bars", src: []byte("---\nTimeSignature: 3/4\n---\n" + table + "| A | l4cde | f2. | [g8]6 |\n| B | l4c | d2 | c2e4^ |\n| B | 2e4 | ts2/4 c4d4 | {3:efg}4d4 |\n"),
+			meters: []Event{{Kind: TimeSignature, Data: []byte{0x3, 0x2, 0x18, 0x8}}, {Tick: 8640, Kind: TimeSignature, Data: []byte{0x2, 0x2, 0x18, 0x8}}},
+			wantErr: "test.md:7:3:0: B: bar 2 is 1920 ticks, want 2880 for 3/4\n" +
+				"test.md:7:2:0: B: bar 1 is 960 ticks, but A is 2880 ticks"},
+		{name: "loop over bars", src: []byte("---\nTimeSignature: 2/4\n---\n" + table + "| A | [c4d4 | e4f4 | g4a4]3 |\n| B | [c2 | d4 ]2 | c2 |\n"),
+			wantErr: "test.md:7:3:0: B: bar 2 is 960 ticks, want 1920 for 2/4"},
+		{name: "swing unit too short", src: []byte("---\nSwing: 60,5000\n---\n" + table + "| A | cdef |\n")},
+		{name: "swing with divisions 1", src: []byte("---\nDivisions: 1\nSwing: 60\n---\n" + table + "| A | cdef |\n")},
+		{name: "@w with divisions 1", src: []byte("---\nDivisions: 1\n---\n" + table + "| A | @w12 cdef |\n")},
+		{name: "bars with ts", src: []byte(table + "| A | ts3/4 l4 cde | cdef | cde |\n"),
+			wantErr: "test.md:3:3:0: A: bar 2 is 3840 ticks, want 2880 for 3/4"},
+		{name: "empty bars", src: []byte("---\nTimeSignature: 4/4\n---\n" + table + "| A | v80 | c1 |  |\n"),
+			wantErr: "test.md:6:4:0: A: bar 3 is 0 ticks, want 3840 for 4/4"},
+		{name: "empty bar with ts", src: []byte(table + "| A | ts3/4 c2. | v80 | c2. |\n"),
+			wantErr: "test.md:3:3:0: A: bar 2 is 0 ticks, want 2880 for 3/4"},
+		{name: "unchecked", src: []byte(table + "| A | c | d | e |\n"),
+			meters: []Event{{Kind: TimeSignature, Data: []byte{0x4, 0x2, 0x18, 0x8}}}},
+		{name: "conflict", src: []byte(table + "| A | c1 | ts3/4 c2. | c |\n| B | c1 | ts6/8 c2. | c |\n| C | ts3/4 c1 | c1 | c |\n"),
+			meters: []Event{{Kind: TimeSignature, Data: []byte{0x3, 0x2, 0x18, 0x8}}, {Tick: 3840, Kind: TimeSignature, Data: []byte{0x3, 0x2, 0x18, 0x8}}},
+			wantErr: "test.md:3:4:0: A: bar 3 is 480 ticks, want 2880 for 3/4\n" +
+				"test.md:4:3:0: B: time signature 6/8 at tick 3840 conflicts with time signature 3/4\n" +
+				"test.md:4:4:0: B: bar 3 is 480 ticks, want 2880 for 6/8\n" +
+				"test.md:5:2:0: C: bar 1 is 3840 ticks, want 2880 for 3/4\n" +
+				"test.md:5:3:0: C: bar 2 is 3840 ticks, want 2880 for 3/4\n" +
+				"test.md:5:4:0: C: bar 3 is 480 ticks, want 2880 for 3/4\n" +
+				"test.md:3:3:0: A: bar 2 is 2880 ticks, but C is 3840 ticks\n" +
+				"test.md:4:3:0: B: bar 2 is 2880 ticks, but C is 3840 ticks"},
+		{name: "alignment", src: []byte(table + "| A | c1 | c2 | c1 |\n| B | c1 | [c4]3 | c2 |\n| A | c2 | c1 | c |\n| B | c1 | c1 | c |\n"),
+			wantErr: "test.md:3:3:0: A: bar 2 is 1920 ticks, but B is 2880 ticks\n" +
+				"test.md:5:2:0: A: bar 4 is 1920 ticks, but B is 3840 ticks\n" +
+				"test.md:4:4:0: B: bar 3 is 1920 ticks, but A is 3840 ticks"},
+		{name: "alignment with meter", src: []byte("---\nTimeSignature: 3/4\n---\n" + table + "| A | l4 c | cde | cde |\n| B | l4 cd | cde | cde |\n"),
+			wantErr: "test.md:6:2:0: A: bar 1 is 960 ticks, but B is 1920 ticks"},
+		{name: "alignment with empty cells", src: []byte(table + "| A | c1 |  | e1 |\n| B | c1 | d1 | e1 |\n| A | c1 | v80 | e1 |\n| B | c1 | d1 | e1 |\n"),
+			wantErr: "test.md:3:3:0: A: bar 2 is 0 ticks, but B is 3840 ticks\n" +
+				"test.md:5:3:0: A: bar 5 is 0 ticks, but B is 3840 ticks"},
+		{name: "auto pad", src: []byte("---\nAutoPad: true\n---\n" + table + "| A | m\"1\" c2 | m\"2\" c1 | c |\n| B | c1 | c2 | m\"3\" c |\n"),
+			texts: []Event{
+				{Kind: Marker, Data: []byte("1")},
+				{Tick: 3840, Kind: Marker, Data: []byte("2")},
+				{Tick: 7680, Kind: Marker, Data: []byte("3")},
+			},
+			ends: []int{8160, 8160}},
+		{name: "auto pad empty cells", src: []byte("---\nAutoPad: true\n---\n" + table + "| A | c1 |  | m\"1\" e1 |\n| B | c1 | d1 | e1 |\n| A | c1 | v80 | m\"2\" e1 |\n| B | c1 | d1 | e1 |\n"),
+			texts: []Event{
+				{Tick: 7680, Kind: Marker, Data: []byte("1")},
+				{Tick: 19200, Kind: Marker, Data: []byte("2")},
+			},
+			ends: []int{23040, 23040}},
+		{name: "tempo", src: []byte("---\nTempo: 100\n---\n" + table + "| A | t120 c1 | t~180,4 c1 | t90 c |\n| B | t120 c1 | c1 | t90 c |\n"),
+			tempos: []Event{
+				{Kind: SetTempo, Data: []byte{0x7, 0xa1, 0x20}},             // 120
+				{Tick: 3840, Kind: SetTempo, Data: []byte{0x6, 0xc8, 0x1c}}, // 135
+				{Tick: 4080, Kind: SetTempo, Data: []byte{0x6, 0x1a, 0x80}}, // 150
+				{Tick: 4320, Kind: SetTempo, Data: []byte{0x5, 0x8c, 0x74}}, // 165
+				{Tick: 4560, Kind: SetTempo, Data: []byte{0x5, 0x16, 0x15}}, // 180
+				{Tick: 7680, Kind: SetTempo, Data: []byte{0xa, 0x2c, 0x2a}}, // 90
+			}},
+		{name: "texts", src: []byte("---\nComposer: C\nCopyright: (c) R\n---\n" + table + "| A | m\"Verse\" c1 | m\"Chorus\" c1 | c |\n| B | m\"Verse\" c1 | c1 | m\"End\" c |\n"),
+			texts: []Event{
+				{Kind: Copyright, Data: []byte("(c) R")},
+				{Kind: Text, Data: []byte("C")},
+				{Kind: Marker, Data: []byte("Verse")},
+				{Tick: 3840, Kind: Marker, Data: []byte("Chorus")},
+				{Tick: 7680, Kind: Marker, Data: []byte("End")},
+			}},
+		{name: "loop point", src: []byte(table + "| A | c1 | L c1 | c |\n| B | c1 | L c1 | c2 |\n| C | c1 |\n"),
+			texts: []Event{
+				{Tick: 3840, Kind: Marker, Data: []byte("loopStart")},
+				{Tick: 9600, Kind: Marker, Data: []byte("loopEnd")},
+			}},
+		{name: "loop point mismatch", src: []byte(table + "| A | c1 | L c1 |\n| B | L c1 | c1 |\n| C | L c1 | L c1 |\n"),
+			wantErr: "test.md:4:2:0: B: loop point at tick 0 does not match A at tick 3840\n" +
+				"test.md:5:3:0: C: duplicate loop point\n" +
+				"test.md:5:2:0: C: loop point at tick 0 does not match A at tick 3840"},
+		{name: "marker conflict", src: []byte(table + "| A | m\"Verse\" c1 |\n| B | m\"Intro\" c1 |\n"),
+			wantErr: "test.md:4:2:0: B: marker \"Intro\" at tick 0 conflicts with marker \"Verse\""},
+		{name: "tempo conflict", src: []byte(table + "| A | c1 | t120 c1 |\n| B | c1 | t130 c1 |\n"),
+			wantErr: "test.md:4:3:0: B: tempo 130 at tick 3840 conflicts with tempo 120"},
+		{name: "macros", src: []byte("| macro | mml |\n|---|---|\n| mark | m\"?1\" |\n| bad | c *xx |\n\n" + table + "| A | !mark(V) c1 | $10 !bad | !nope c |\n"),
+			texts: []Event{{Kind: Marker, Data: []byte("V")}},
+			wantErr: "test.md:8:4:0: A: unknown macro \"nope\"\n" +
+				"test.md:8:3:4: A: unknown drum \"xx\""},
+		{name: "drums", src: []byte(table + "| A | *bd | $10 *xx | *bd r |\n"),
+			wantErr: "test.md:3:2:0: A: drum \"bd\" outside channel 10\n" +
+				"test.md:3:3:4: A: unknown drum \"xx\""},
+		{name: "note out of range", src: []byte(table + "| A | k20 o8 b | [>c]2 | r |\n"),
+			wantErr: "test.md:3:2:7: A: note number 139 out of range\n" +
+				"test.md:3:3:2: A: note number 140 out of range\n" +
+				"test.md:3:3:2: A: note number 152 out of range"},
+		{name: "errors", src: []byte("| name | 1 | 2 |\n|---|---|---|\n| A | c]de | f {ga |\n| B | [c | j |\n"),
+			wantErr: "test.md:3:2:1: A: unmatched ']'\n" +
+				"test.md:3:3:2: A: unclosed '{'\n" +
+				"test.md:4:2:0: B: unclosed '['\n" +
+				"test.md:4:3:0: B: unknown command \"j\""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mm, err := MDtoMMLWithError("test.md", tt.src)
+			assert.NoError(t, err)
+			mm, err = mm.MMLtoSMFWithError()
+			if tt.meters != nil {
+				got := []Event{}
+				for _, e := range mm.Conductor.Sequence.Events {
+					if e.Kind == TimeSignature {
+						got = append(got, e)
+					}
+				}
+				assert.Equal(t, tt.meters, got)
+			}
+			if tt.texts != nil {
+				got := []Event{}
+				for _, e := range mm.Conductor.Sequence.Events {
+					if e.Kind == Text || e.Kind == Copyright || e.Kind == Marker {
+						got = append(got, e)
+					}
+				}
+				assert.Equal(t, tt.texts, got)
+			}
+			if tt.ends != nil {
+				got := []int{}
+				for _, t := range mm.Tracks {
+					got = append(got, t.Sequence.End)
+				}
+				assert.Equal(t, tt.ends, got)
+			}
+			if tt.tempos != nil {
+				got := []Event{}
+				for _, e := range mm.Conductor.Sequence.Events {
+					if e.Kind == SetTempo {
+						got = append(got, e)
+					}
+				}
+				assert.Equal(t, tt.tempos, got)
+			}
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMDMML_MMLtoSMF_resetWait(t *testing.T) {
+	mm := MDtoMML([]byte("---\nReset: GS\n---\n| name | 1 | 2 |\n|---|---|---|\n| A | @1 c1 | t100 L c |\n"))
+	mm = mm.MMLtoSMF()
+	wait := 192 // 120 BPM で 100ms
+	conductor := []Event{}
+	for _, e := range mm.Conductor.Sequence.Events {
+		if e.Kind == SysEx || e.Kind == SetTempo || e.Kind == Marker {
+			conductor = append(conductor, Event{Tick: e.Tick, Kind: e.Kind})
+		}
+	}
+	assert.Equal(t, []Event{
+		{Kind: SysEx},
+		{Kind: SetTempo},
+		{Tick: 3840 + wait, Kind: SetTempo},
+		{Tick: 3840 + wait, Kind: Marker},
+		{Tick: 4320 + wait, Kind: Marker},
+	}, conductor)
+	for _, e := range mm.Tracks[0].Sequence.Events {
+		assert.GreaterOrEqual(t, e.Tick, wait, "%v", e)
+	}
+	assert.Equal(t, wait, mm.Tracks[0].Sequence.Events[0].Tick)
+	assert.Equal(t, 4320+wait, mm.Tracks[0].Sequence.End)
+	// パートの CC#121 と CC#7 もリセットの後に出力する
+	assert.Equal(t, []byte{0x00, 0xff, 0x03, 0x01, 0x41, 0x00, 0xff, 0x20, 0x01, 0x00, 0x00, 0xff, 0x21, 0x01, 0x00,
+		0x81, 0x40, 0xb0, 0x79, 0x00}, mm.Tracks[0].smf[8:28])
+}
+
+func Test_splitRow(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want []string
+	}{
+		{name: "normal", line: "| A | cde | fga |", want: []string{"", " A ", " cde ", " fga ", ""}},
+		{name: "escape", line: "| A | [c\\|d]3 | [e\\|f\\|g] |", want: []string{"", " A ", " [c|d]3 ", " [e|f|g] ", ""}},
+		{name: "no pipe", line: "A", want: []string{"A"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitRow(tt.line)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
 func Test_noteOnOff(t *testing.T) {
 	type args struct {
+		tick int
 		ch   int
-		oct  int
-		note string
+		n    int
 		vel  int
 		len  int
 	}
 	tests := []struct {
 		name string
 		args args
-		want []byte
+		want []Event
 	}{
-		{name: "v100l8o4c", args: args{ch: 1, oct: 4, note: "c", vel: 100, len: 4}, want: []byte{
-			0x00, 0x91, 0x3c, 0x64, // Note ON
-			0x87, 0x40, 0x81, 0x3c, 0x00, // Note OFF
-		}},
-		{name: "rest", args: args{ch: 1, oct: 4, note: "r", vel: 100, len: 4}, want: []byte{
-			0x00, 0x91, 0x00, 0x00, // Note ON
-			0x87, 0x40, 0x81, 0x00, 0x00, // Note OFF
+		{name: "v100l8o4c", args: args{tick: 480, ch: 1, n: 60, vel: 100, len: 4}, want: []Event{
+			{Tick: 480, Channel: 1, Kind: NoteOn, Data: []byte{0x3c, 0x64}},
+			{Tick: 1440, Channel: 1, Kind: NoteOff, Data: []byte{0x3c, 0x00}},
 		}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := noteOnOff(tt.args.ch, tt.args.oct, tt.args.note, tt.args.vel, lenToTick(960, tt.args.len))
+			got := noteOnOff(tt.args.tick, tt.args.ch, tt.args.n, tt.args.vel, lenToTick(960, tt.args.len))
 			assert.Equal(t, tt.want, got)
 		})
 	}
@@ -212,36 +562,6 @@ func Test_lenToTick(t *testing.T) {
 	}
 }
 
-func Test_num(t *testing.T) {
-	type args struct {
-		s   string
-		min int
-		max int
-	}
-	tests := []struct {
-		name  string
-		args  args
-		want  int
-		want1 int
-	}{
-		{name: "1桁", args: args{s: "1a", min: 1, max: 10}, want: 1, want1: 1},
-		{name: "2桁", args: args{s: "12a", min: 1, max: 15}, want: 12, want1: 2},
-		{name: "min", args: args{s: "12a", min: 20, max: 30}, want: 20, want1: 2},
-		{name: "max", args: args{s: "12a", min: 1, max: 10}, want: 10, want1: 2},
-	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			got, got1 := num(tt.args.s, tt.args.min, tt.args.max)
-			if got != tt.want {
-				t.Errorf("num() got = %v, want %v", got, tt.want)
-			}
-			if got1 != tt.want1 {
-				t.Errorf("num() got1 = %v, want %v", got1, tt.want1)
-			}
-		})
-	}
-}
-
 func TestMDMML_toSMF(t *testing.T) {
 	type args struct {
 		mml string
@@ -311,8 +631,8 @@ func TestMDMML_toSMF(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			events := toEvents(tt.args.mml, 0, 960)
-			got := buildSMF("", events, 0)
+			seq := toEvents(parse(t, tt.args.mml), 0, 960)
+			got := buildSMF("", seq, 0, 0)
 			assert.Equal(t, tt.want, got)
 		})
 	}
@@ -344,6 +664,8 @@ func TestMDMML_MMLtoSMF(t *testing.T) {
 		divisions int
 		title     string
 		tempo     int
+		key       *keySignature
+		reset     string
 		header    []byte
 		Conductor Track
 		Tracks    []Track
@@ -353,6 +675,52 @@ func TestMDMML_MMLtoSMF(t *testing.T) {
 		fields fields
 		want   *MDMML
 	}{
+		{name: "reset", fields: fields{divisions: 960, tempo: 120, reset: "GS"}, want: &MDMML{
+			divisions: 960, tempo: 120, reset: "GS",
+			header: []uint8{
+				0x4d, 0x54, 0x68, 0x64,
+				0x0, 0x0, 0x0, 0x6,
+				0x0, 0x1, 0x0, 0x1, 0x3, 0xc0,
+			},
+			Conductor: Track{name: "Conductor",
+				Sequence: Sequence{Events: []Event{
+					{Kind: TrackName, Data: []byte{}},
+					{Kind: SysEx, Data: []byte{0x41, 0x10, 0x42, 0x12, 0x40, 0x0, 0x7f, 0x0, 0x41, 0xf7}},
+					{Kind: SetTempo, Data: []byte{0x7, 0xa1, 0x20}},
+					{Kind: TimeSignature, Data: []byte{0x4, 0x2, 0x18, 0x8}},
+				}},
+				smf: []uint8{
+					0x4d, 0x54, 0x72, 0x6b,
+					0x0, 0x0, 0x0, 0x24,
+					0x0, 0xff, 0x3, 0x0,
+					0x0, 0xf0, 0xa, 0x41, 0x10, 0x42, 0x12, 0x40, 0x0, 0x7f, 0x0, 0x41, 0xf7,
+					0x0, 0xff, 0x51, 0x3, 0x7, 0xa1, 0x20,
+					0x0, 0xff, 0x58, 0x4, 0x4, 0x2, 0x18, 0x8,
+					0x0, 0xff, 0x2f, 0x0,
+				}}}},
+		{name: "key", fields: fields{divisions: 960, tempo: 120, key: &keySignature{sf: -3}}, want: &MDMML{
+			divisions: 960, tempo: 120, key: &keySignature{sf: -3},
+			header: []uint8{
+				0x4d, 0x54, 0x68, 0x64,
+				0x0, 0x0, 0x0, 0x6,
+				0x0, 0x1, 0x0, 0x1, 0x3, 0xc0,
+			},
+			Conductor: Track{name: "Conductor",
+				Sequence: Sequence{Events: []Event{
+					{Kind: TrackName, Data: []byte{}},
+					{Kind: SetTempo, Data: []byte{0x7, 0xa1, 0x20}},
+					{Kind: TimeSignature, Data: []byte{0x4, 0x2, 0x18, 0x8}},
+					{Kind: KeySignature, Data: []byte{0xfd, 0x0}},
+				}},
+				smf: []uint8{
+					0x4d, 0x54, 0x72, 0x6b,
+					0x0, 0x0, 0x0, 0x1d,
+					0x0, 0xff, 0x3, 0x0,
+					0x0, 0xff, 0x51, 0x3, 0x7, 0xa1, 0x20,
+					0x0, 0xff, 0x58, 0x4, 0x4, 0x2, 0x18, 0x8,
+					0x0, 0xff, 0x59, 0x2, 0xfd, 0x0,
+					0x0, 0xff, 0x2f, 0x0,
+				}}}},
 		{name: "default", want: &MDMML{
 			divisions: 0, title: "", tempo: 0,
 			header: []uint8{
@@ -361,6 +729,11 @@ func TestMDMML_MMLtoSMF(t *testing.T) {
 				0x0, 0x1, 0x0, 0x1, 0x0, 0x0,
 			},
 			Conductor: Track{name: "Conductor", mmls: []string(nil),
+				Sequence: Sequence{Events: []Event{
+					{Kind: TrackName, Data: []byte{}},
+					{Kind: SetTempo, Data: []byte{0x0, 0x0, 0x0}},
+					{Kind: TimeSignature, Data: []byte{0x4, 0x2, 0x18, 0x8}},
+				}},
 				smf: []uint8{
 					0x4d, 0x54, 0x72, 0x6b,
 					0x0, 0x0, 0x0, 0x17,
@@ -377,6 +750,8 @@ func TestMDMML_MMLtoSMF(t *testing.T) {
 				divisions: tt.fields.divisions,
 				title:     tt.fields.title,
 				tempo:     tt.fields.tempo,
+				key:       tt.fields.key,
+				reset:     tt.fields.reset,
 				header:    tt.fields.header,
 				Conductor: tt.fields.Conductor,
 				Tracks:    tt.fields.Tracks,
@@ -424,7 +799,7 @@ func TestMDMML_toEvents(t *testing.T) {
 			0x0, 0x90, 0x3f, 0x64,
 			0x0, 0x90, 0x44, 0x64,
 			0x0, 0x90, 0x48, 0x64,
-			0x9c, 0x10, 0x80, 0x3d, 0x0,
+			0x90, 0x70, 0x80, 0x3d, 0x0, // 1440+720
 			0x0, 0x80, 0x3f, 0x0,
 			0x0, 0x80, 0x44, 0x0,
 			0x0, 0x80, 0x48, 0x0,
@@ -447,10 +822,94 @@ func TestMDMML_toEvents(t *testing.T) {
 			0x0, 0xb0, 0xa, 127,
 			0x0, 0xb0, 0xa, 127,
 		}},
-		{name: "tempo", args: args{mml: "t0t120t250"}, want: []byte{
-			0x0, 0xff, 0x51, 0x3, 0x3, 0x93, 0x87, 0x0,
-			0x0, 0xff, 0x51, 0x3, 0x7, 0xa1, 0x20,
-			0x0, 0xff, 0x51, 0x3, 0x3, 0xa9, 0x80,
+		{name: "control change", args: args{mml: "@v90@x200c@s1@m64@r40@c0y74,20@s0"}, want: []byte{
+			0x0, 0xb0, 0x7, 90,
+			0x0, 0xb0, 0xb, 127,
+			0x0, 0x90, 0x3c, 0x64, 0x83, 0x60, 0x80, 0x3c, 0x0,
+			0x0, 0xb0, 0x40, 127,
+			0x0, 0xb0, 0x1, 64,
+			0x0, 0xb0, 0x5b, 40,
+			0x0, 0xb0, 0x5d, 0,
+			0x0, 0xb0, 0x4a, 20,
+			0x0, 0xb0, 0x40, 0,
+		}},
+		{name: "pitch bend", args: args{mml: "@b-9000@b0@b100@br30"}, want: []byte{
+			0x0, 0xe0, 0x0, 0x0,
+			0x0, 0xe0, 0x0, 0x40,
+			0x0, 0xe0, 0x64, 0x40,
+			0x0, 0xb0, 0x65, 0x0,
+			0x0, 0xb0, 0x64, 0x0,
+			0x0, 0xb0, 0x6, 24,
+			0x0, 0xb0, 0x26, 0x0,
+		}},
+		{name: "slide", args: args{mml: "@bs4c&d4@br12c&>c4"}, want: []byte{
+			0x0, 0x90, 0x3c, 0x64,
+			0x0, 0xe0, 0x0, 0x50, // ベンド幅2で全音の1/4
+			0x81, 0x70, 0xe0, 0x0, 0x60,
+			0x81, 0x70, 0xe0, 0x0, 0x70,
+			0x81, 0x70, 0xe0, 0x7f, 0x7f,
+			0x81, 0x70, 0x80, 0x3c, 0x0,
+			0x0, 0xe0, 0x0, 0x40,
+			0x0, 0xb0, 0x65, 0x0,
+			0x0, 0xb0, 0x64, 0x0,
+			0x0, 0xb0, 0x6, 12,
+			0x0, 0xb0, 0x26, 0x0,
+			0x0, 0x90, 0x3c, 0x64,
+			0x0, 0xe0, 0x0, 0x50, // ベンド幅12で1オクターブ
+			0x81, 0x70, 0xe0, 0x0, 0x60,
+			0x81, 0x70, 0xe0, 0x0, 0x70,
+			0x81, 0x70, 0xe0, 0x7f, 0x7f,
+			0x81, 0x70, 0x80, 0x3c, 0x0,
+			0x0, 0xe0, 0x0, 0x40,
+		}},
+		{name: "slide from bend", args: args{mml: "@b2000@bs2c&d4c4"}, want: []byte{
+			0x0, 0xe0, 0x50, 0x4f, // 2000
+			0x0, 0x90, 0x3c, 0x64,
+			0x0, 0xe0, 0x50, 0x6f, // 2000 から全音の1/2
+			0x83, 0x60, 0xe0, 0x7f, 0x7f,
+			0x83, 0x60, 0x80, 0x3c, 0x0,
+			0x0, 0xe0, 0x50, 0x4f, // @b の値に戻す
+			0x0, 0x90, 0x3c, 0x64,
+			0x87, 0x40, 0x80, 0x3c, 0x0,
+		}},
+		{name: "auto pan", args: args{mml: "p40@lp0,480,10,2c4@lp0c4"}, want: []byte{
+			0x0, 0xb0, 0xa, 40,
+			0x0, 0x90, 0x3c, 0x64,
+			0x0, 0xb0, 0xa, 50,
+			0x81, 0x70, 0xb0, 0xa, 30,
+			0x81, 0x70, 0xb0, 0xa, 50,
+			0x81, 0x70, 0xb0, 0xa, 30,
+			0x81, 0x70, 0x80, 0x3c, 0x0,
+			0x0, 0xb0, 0xa, 40,
+			0x0, 0x90, 0x3c, 0x64, 0x87, 0x40, 0x80, 0x3c, 0x0,
+		}},
+		{name: "velocity step", args: args{mml: "v100(c)2c@vs1(c"}, want: []byte{
+			0x0, 0x90, 0x3c, 92, 0x83, 0x60, 0x80, 0x3c, 0x0,
+			0x0, 0x90, 0x3c, 108, 0x83, 0x60, 0x80, 0x3c, 0x0,
+			0x0, 0x90, 0x3c, 107, 0x83, 0x60, 0x80, 0x3c, 0x0,
+		}},
+		{name: "accent", args: args{mml: "@va10c'{c'e}"}, want: []byte{
+			0x0, 0x90, 0x3c, 110, 0x83, 0x60, 0x80, 0x3c, 0x0,
+			0x0, 0x90, 0x3c, 110,
+			0x0, 0x90, 0x40, 100,
+			0x83, 0x60, 0x80, 0x3c, 0x0,
+			0x0, 0x80, 0x40, 0x0,
+		}},
+		{name: "velocity ramp end", args: args{mml: "v40v~80,2l4ccc"}, want: []byte{
+			0x0, 0x90, 0x3c, 40, 0x87, 0x40, 0x80, 0x3c, 0x0,
+			0x0, 0x90, 0x3c, 60, 0x87, 0x40, 0x80, 0x3c, 0x0,
+			0x0, 0x90, 0x3c, 80, 0x87, 0x40, 0x80, 0x3c, 0x0,
+		}},
+		{name: "expression ramp", args: args{mml: "@x~67,%120"}, want: []byte{
+			0x0, 0xb0, 0xb, 97,
+			0x3c, 0xb0, 0xb, 67,
+		}},
+		{name: "swing", args: args{mml: "@w75cdef@w50c"}, want: []byte{
+			0x0, 0x90, 0x3c, 0x64, 0x85, 0x50, 0x80, 0x3c, 0x0, // 0～720
+			0x0, 0x90, 0x3e, 0x64, 0x81, 0x70, 0x80, 0x3e, 0x0, // 720～960
+			0x0, 0x90, 0x40, 0x64, 0x85, 0x50, 0x80, 0x40, 0x0,
+			0x0, 0x90, 0x41, 0x64, 0x81, 0x70, 0x80, 0x41, 0x0,
+			0x0, 0x90, 0x3c, 0x64, 0x83, 0x60, 0x80, 0x3c, 0x0,
 		}},
 		{name: "vel", args: args{mml: "v0cv1cv127cv128c"}, want: []byte{
 			0x0, 0x90, 0x3c, 0x0, 0x83, 0x60, 0x80, 0x3c, 0x0,
@@ -464,10 +923,95 @@ func TestMDMML_toEvents(t *testing.T) {
 			0x0, 0x9e, 0x3c, 0x64, 0x83, 0x60, 0x8e, 0x3c, 0x0,
 			0x0, 0x9f, 0x3c, 0x64, 0x83, 0x60, 0x8f, 0x3c, 0x0,
 		}},
+		{name: "gate", args: args{mml: "q6c4d@q60e8"}, want: []byte{
+			0x0, 0x90, 0x3c, 0x64, 0x85, 0x50, 0x80, 0x3c, 0x0, // 960*6/8 = 720
+			0x81, 0x70, 0x90, 0x3e, 0x64, 0x82, 0x68, 0x80, 0x3e, 0x0, // 480*6/8 = 360
+			0x78, 0x90, 0x40, 0x64, 0x82, 0x2c, 0x80, 0x40, 0x0, // 480*6/8-60 = 300
+		}},
+		{name: "gate chode", args: args{mml: "q4{ce}4"}, want: []byte{
+			0x0, 0x90, 0x3c, 0x64,
+			0x0, 0x90, 0x40, 0x64,
+			0x83, 0x60, 0x80, 0x3c, 0x0,
+			0x0, 0x80, 0x40, 0x0,
+		}},
+		{name: "tuplet", args: args{mml: "{3:cd{ce}}4"}, want: []byte{
+			0x0, 0x90, 0x3c, 0x64, 0x82, 0x40, 0x80, 0x3c, 0x0, // 320
+			0x0, 0x90, 0x3e, 0x64, 0x82, 0x40, 0x80, 0x3e, 0x0,
+			0x0, 0x90, 0x3c, 0x64,
+			0x0, 0x90, 0x40, 0x64,
+			0x82, 0x40, 0x80, 0x3c, 0x0,
+			0x0, 0x80, 0x40, 0x0,
+		}},
+		{name: "tuplet default length", args: args{mml: "l16{5:rrrr c}"}, want: []byte{
+			0x86, 0x0, 0x90, 0x3c, 0x64, 0x81, 0x40, 0x80, 0x3c, 0x0, // 5連16分は4つ分(960)を5等分
+		}},
+		{name: "nested tuplet", args: args{mml: "{3:c{3:ddd}e}2"}, want: []byte{
+			0x0, 0x90, 0x3c, 0x64, 0x83, 0x60, 0x80, 0x3c, 0x0, // 1920を 480:960:480 に分ける
+			0x0, 0x90, 0x3e, 0x64, 0x82, 0x40, 0x80, 0x3e, 0x0, // 960を3等分
+			0x0, 0x90, 0x3e, 0x64, 0x82, 0x40, 0x80, 0x3e, 0x0,
+			0x0, 0x90, 0x3e, 0x64, 0x82, 0x40, 0x80, 0x3e, 0x0,
+			0x0, 0x90, 0x40, 0x64, 0x83, 0x60, 0x80, 0x40, 0x0,
+		}},
+		{name: "tick length", args: args{mml: "c%100r%50{ce}%7.l%300d^%10."}, want: []byte{
+			0x0, 0x90, 0x3c, 0x64, 0x64, 0x80, 0x3c, 0x0,
+			0x32, 0x90, 0x3c, 0x64,
+			0x0, 0x90, 0x40, 0x64,
+			0xa, 0x80, 0x3c, 0x0,
+			0x0, 0x80, 0x40, 0x0,
+			0x0, 0x90, 0x3e, 0x64, 0x82, 0x3b, 0x80, 0x3e, 0x0, // 300+15
+		}},
+		{name: "tie default length", args: args{mml: "c4^"}, want: []byte{
+			0x0, 0x90, 0x3c, 0x64, 0x8b, 0x20, 0x80, 0x3c, 0x0, // 960+480
+		}},
+		{name: "key signature", args: args{mml: "ks2fc=d-{fc}"}, want: []byte{
+			0x0, 0x90, 0x42, 0x64, 0x83, 0x60, 0x80, 0x42, 0x0, // f+
+			0x0, 0x90, 0x3c, 0x64, 0x83, 0x60, 0x80, 0x3c, 0x0, // c=
+			0x0, 0x90, 0x3d, 0x64, 0x83, 0x60, 0x80, 0x3d, 0x0, // d-
+			0x0, 0x90, 0x42, 0x64,
+			0x0, 0x90, 0x3d, 0x64,
+			0x83, 0x60, 0x80, 0x42, 0x0,
+			0x0, 0x80, 0x3d, 0x0,
+		}},
+		{name: "transpose", args: args{mml: "k-2c_+1c_-3ck0c"}, want: []byte{
+			0x0, 0x90, 0x3a, 0x64, 0x83, 0x60, 0x80, 0x3a, 0x0,
+			0x0, 0x90, 0x3b, 0x64, 0x83, 0x60, 0x80, 0x3b, 0x0,
+			0x0, 0x90, 0x38, 0x64, 0x83, 0x60, 0x80, 0x38, 0x0,
+			0x0, 0x90, 0x3c, 0x64, 0x83, 0x60, 0x80, 0x3c, 0x0,
+		}},
+		{name: "transpose max", args: args{mml: "k100c"}, want: []byte{
+			0x0, 0x90, 0x7f, 0x64, 0x83, 0x60, 0x80, 0x7f, 0x0,
+		}},
+		{name: "drum", args: args{mml: "*bd*sd'4.{*hh*oh}", ch: 9}, want: []byte{
+			0x0, 0x99, 0x24, 0x64, 0x83, 0x60, 0x89, 0x24, 0x0,
+			0x0, 0x99, 0x26, 0x78, 0x8b, 0x20, 0x89, 0x26, 0x0,
+			0x0, 0x99, 0x2a, 0x64,
+			0x0, 0x99, 0x2e, 0x64,
+			0x83, 0x60, 0x89, 0x2a, 0x0,
+			0x0, 0x89, 0x2e, 0x0,
+		}},
+		{name: "note number", args: args{mml: "k2n36,4{n38n42'}"}, want: []byte{
+			0x0, 0x90, 0x24, 0x64, 0x87, 0x40, 0x80, 0x24, 0x0,
+			0x0, 0x90, 0x26, 0x64,
+			0x0, 0x90, 0x2a, 0x78,
+			0x83, 0x60, 0x80, 0x26, 0x0,
+			0x0, 0x80, 0x2a, 0x0,
+		}},
+		{name: "sysex", args: args{mml: `x"7e7f0901"c`}, want: []byte{
+			0x0, 0xf0, 0x5, 0x7e, 0x7f, 0x9, 0x1, 0xf7,
+			0x0, 0x90, 0x3c, 0x64, 0x83, 0x60, 0x80, 0x3c, 0x0,
+		}},
+		{name: "loop point", args: args{mml: "cLd"}, want: []byte{
+			0x0, 0x90, 0x3c, 0x64, 0x83, 0x60, 0x80, 0x3c, 0x0,
+			0x0, 0xb0, 0x6f, 0x0,
+			0x0, 0x90, 0x3e, 0x64, 0x83, 0x60, 0x80, 0x3e, 0x0,
+		}},
+		{name: "gate min", args: args{mml: "@q1000c"}, want: []byte{
+			0x0, 0x90, 0x3c, 0x64, 0x1, 0x80, 0x3c, 0x0,
+		}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := toEvents(tt.args.mml, tt.args.ch, 960)
+			got := encode(toEvents(parse(t, tt.args.mml), tt.args.ch, 960).Events)
 			assert.Equal(t, tt.want, got)
 		})
 	}
@@ -475,9 +1019,9 @@ func TestMDMML_toEvents(t *testing.T) {
 
 func Test_buildSMF(t *testing.T) {
 	type args struct {
-		title  string
-		events []byte
-		ch     int
+		title string
+		seq   Sequence
+		ch    int
 	}
 	tests := []struct {
 		name string
@@ -494,10 +1038,20 @@ func Test_buildSMF(t *testing.T) {
 			0x0, 0xb0, 0x7, 0x64,
 			0x0, 0xff, 0x2f, 0x0,
 		}},
+		{name: "end", args: args{seq: Sequence{End: 960}, ch: 1}, want: []byte{
+			0x4d, 0x54, 0x72, 0x6b,
+			0x0, 0x0, 0x0, 0x1b,
+			0x0, 0xff, 0x3, 0x0,
+			0x0, 0xff, 0x20, 0x1, 0x1,
+			0x0, 0xff, 0x21, 0x1, 0x1,
+			0x0, 0xb1, 0x79, 0x0,
+			0x0, 0xb1, 0x7, 0x64,
+			0x87, 0x40, 0xff, 0x2f, 0x0,
+		}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := buildSMF(tt.args.title, tt.args.events, tt.args.ch)
+			got := buildSMF(tt.args.title, tt.args.seq, tt.args.ch, 0)
 			assert.Equal(t, tt.want, got)
 		})
 	}
@@ -505,9 +1059,10 @@ func Test_buildSMF(t *testing.T) {
 
 func Test_notesOnOff(t *testing.T) {
 	type args struct {
+		tick  int
 		ch    int
 		notes []note
-		tick  int
+		len   int
 	}
 	tests := []struct {
 		name string
@@ -515,15 +1070,450 @@ func Test_notesOnOff(t *testing.T) {
 		want []byte
 	}{
 		{name: "default", want: []byte{}},
+		{name: "ce", args: args{ch: 1, notes: []note{{num: 60, vel: 100}, {num: 64, vel: 90}}, len: 480}, want: []byte{
+			0x0, 0x91, 0x3c, 0x64,
+			0x0, 0x91, 0x40, 0x5a,
+			0x83, 0x60, 0x81, 0x3c, 0x0,
+			0x0, 0x81, 0x40, 0x0,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := encode(notesOnOff(tt.args.tick, tt.args.ch, tt.args.notes, tt.args.len))
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_distribute(t *testing.T) {
+	tests := []struct {
+		name    string
+		total   int
+		weights []int
+		want    []int
+	}{
+		{name: "even", total: 960, weights: []int{1, 1, 1}, want: []int{320, 320, 320}},
+		{name: "remainder", total: 100, weights: []int{480, 480, 480}, want: []int{33, 33, 34}},
+		{name: "ratio", total: 960, weights: []int{480, 960}, want: []int{320, 640}},
+		{name: "zero", total: 960, weights: []int{0, 0}, want: []int{0, 0}},
+		{name: "empty", total: 960, want: []int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := distribute(tt.total, tt.weights)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_compiler_tempo(t *testing.T) {
+	tests := []struct {
+		name string
+		mml  string
+		want []Event
+	}{
+		{name: "tempo", mml: "t0t120t250c", want: []Event{
+			{Kind: SetTempo, Data: []byte{0xff, 0xff, 0xff}}, // t1 は3バイトに収まらないので最大値
+			{Kind: SetTempo, Data: []byte{0x7, 0xa1, 0x20}},
+			{Kind: SetTempo, Data: []byte{0x3, 0xa9, 0x80}},
+		}},
+		{name: "ramp", mml: "t100t~120,4c", want: []Event{
+			{Kind: SetTempo, Data: []byte{0x9, 0x27, 0xc0}},
+			{Kind: SetTempo, Data: []byte{0x8, 0xb8, 0x24}},            // 105
+			{Tick: 240, Kind: SetTempo, Data: []byte{0x8, 0x52, 0xae}}, // 110
+			{Tick: 480, Kind: SetTempo, Data: []byte{0x7, 0xf6, 0xb}},  // 115
+			{Tick: 720, Kind: SetTempo, Data: []byte{0x7, 0xa1, 0x20}}, // 120
+		}},
+		{name: "ramp without change", mml: "t~120,%10", want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newCompiler(0, 960)
+			c.compile(parse(t, tt.mml))
+			got := []Event{}
+			for _, ch := range c.changes {
+				got = append(got, ch.event)
+			}
+			if tt.want == nil {
+				tt.want = []Event{}
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_lfo_at(t *testing.T) {
+	tests := []struct {
+		name string
+		wave int
+		want []float64
+	}{
+		{name: "triangle", wave: 0, want: []float64{0, 1, 0, -1}},
+		{name: "sine", wave: 1, want: []float64{0, 1, 0, -1}},
+		{name: "square", wave: 2, want: []float64{1, 1, -1, -1}},
+		{name: "saw", wave: 3, want: []float64{0, 0.5, -1, -0.5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &lfo{rate: 400, wave: tt.wave}
+			for i, want := range tt.want {
+				assert.InDelta(t, want, l.at(i*100), 1e-9)
+			}
+		})
+	}
+}
+
+func Test_compiler_modulate(t *testing.T) {
+	tests := []struct {
+		name  string
+		lfos  map[string]*lfo
+		slide bool
+		want  []Event
+	}{
+		{name: "vibrato", lfos: map[string]*lfo{"v": {delay: 240, rate: 480, depth: 100, on: true}}, want: []Event{
+			pitchBend(360, 0, 100),
+			pitchBend(480, 0, 0),
+			pitchBend(600, 0, -100),
+			pitchBend(720, 0, 0),
+			pitchBend(840, 0, 100),
+			pitchBend(960, 0, 0),
+		}},
+		{name: "tremolo", lfos: map[string]*lfo{"t": {rate: 480, depth: 20, wave: 2, on: true}}, want: []Event{
+			cc(0, 0, 11, 107),
+			cc(240, 0, 11, 127),
+			cc(480, 0, 11, 107),
+			cc(720, 0, 11, 127),
+		}},
+		{name: "off", lfos: map[string]*lfo{"t": {rate: 480, depth: 20}}, want: []Event{}},
+		{name: "slide", lfos: map[string]*lfo{"v": {rate: 480, depth: 100, on: true}}, slide: true, want: []Event{}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := notesOnOff(tt.args.ch, tt.args.notes, tt.args.tick)
+			c := newCompiler(0, 960)
+			c.lfoStep = 120
+			c.lfos = tt.lfos
+			c.modulate(960, tt.slide)
+			assert.Equal(t, tt.want, c.seq.Events)
+		})
+	}
+}
+
+func Test_ramp(t *testing.T) {
+	tests := []struct {
+		name   string
+		from   int
+		to     int
+		length int
+		step   int
+		want   [][2]int
+	}{
+		{name: "up", from: 0, to: 10, length: 100, step: 25, want: [][2]int{{0, 2}, {25, 5}, {50, 7}, {75, 10}}},
+		{name: "skip same value", from: 10, to: 8, length: 100, step: 25, want: [][2]int{{25, 9}, {75, 8}}},
+		{name: "short", from: 0, to: 10, length: 10, step: 25, want: [][2]int{{0, 10}}},
+		{name: "no change", from: 10, to: 10, length: 100, step: 25},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got [][2]int
+			ramp(tt.from, tt.to, tt.length, tt.step, func(offset, v int) {
+				got = append(got, [2]int{offset, v})
+			})
 			assert.Equal(t, tt.want, got)
 		})
 	}
 }
 
+func Test_compiler_swung(t *testing.T) {
+	tests := []struct {
+		name  string
+		swing swing
+		tick  int
+		want  int
+	}{
+		{name: "straight", swing: swing{percent: 50, unit: 8}, tick: 480, want: 480},
+		{name: "off beat", swing: swing{percent: 66, unit: 8}, tick: 480, want: 633},
+		{name: "on beat", swing: swing{percent: 66, unit: 8}, tick: 960, want: 960},
+		{name: "first half", swing: swing{percent: 66, unit: 8}, tick: 240, want: 316},
+		{name: "second half", swing: swing{percent: 66, unit: 8}, tick: 720, want: 796},
+		{name: "16th", swing: swing{percent: 75, unit: 16}, tick: 1200, want: 1320},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newCompiler(0, 960)
+			c.swing = tt.swing
+			assert.Equal(t, tt.want, c.swung(tt.tick))
+		})
+	}
+}
+
+func Test_compiler_humanize(t *testing.T) {
+	compile := func(seed int64) Sequence {
+		c := newCompiler(0, 960)
+		c.human = humanize{tick: 10, vel: 5}
+		c.rnd = rand.New(rand.NewSource(seed))
+		return c.compile(parse(t, "l4cdefgab"))
+	}
+	got := compile(1)
+	assert.Equal(t, got, compile(1), "same seed")
+	assert.NotEqual(t, got, compile(2), "other seed")
+	for i := 0; i < len(got.Events); i += 2 {
+		on, off := got.Events[i], got.Events[i+1]
+		assert.InDelta(t, i/2*960, on.Tick, 10)
+		assert.Equal(t, 960, off.Tick-on.Tick)
+		assert.InDelta(t, 100, int(on.Data[1]), 5)
+	}
+}
+
+func Test_compiler_tupletCommands(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		kind EventKind
+	}{
+		{name: "ramp", src: "@x100 {3:c @x~0,4 d e}2", kind: ControlChange},
+		{name: "lfo", src: "@lv0,100,500 {3:c @lv0 d e}2", kind: PitchBend},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := 0
+			for _, e := range toEvents(parse(t, tt.src), 0, 960).Events {
+				if e.Kind == tt.kind && (e.Kind != ControlChange || e.Data[0] == 11 && e.Data[1] < 100) {
+					got++
+				}
+			}
+			assert.Greater(t, got, 0)
+		})
+	}
+}
+
+func Test_compiler_humanizeRepeat(t *testing.T) {
+	c := newCompiler(0, 960)
+	c.human = humanize{tick: 30}
+	c.rnd = rand.New(rand.NewSource(1))
+	got := c.compile(parse(t, "l8 cccccccc"))
+	offs := map[int]int{}
+	for i := 0; i < len(got.Events); i += 2 {
+		on, off := got.Events[i], got.Events[i+1]
+		assert.GreaterOrEqual(t, on.Tick, offs[60], "note %d starts before the previous note off", i/2)
+		assert.Equal(t, 480, off.Tick-on.Tick)
+		offs[60] = off.Tick
+	}
+}
+
+func Test_parseSwing(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want swing
+	}{
+		{name: "percent", src: "60", want: swing{percent: 60, unit: 8}},
+		{name: "unit", src: "66, 16", want: swing{percent: 66, unit: 16}},
+		{name: "invalid", src: "0"},
+		{name: "invalid unit", src: "60,x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, parseSwing(tt.src))
+		})
+	}
+}
+
+func Test_parseHumanize(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		want   humanize
+		wantOK bool
+	}{
+		{name: "tick", src: "10", want: humanize{tick: 10}, wantOK: true},
+		{name: "tick and velocity", src: "10,8", want: humanize{tick: 10, vel: 8}, wantOK: true},
+		{name: "invalid", src: "a,8"},
+		{name: "too many", src: "1,2,3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseHumanize(tt.src)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.wantOK, ok)
+		})
+	}
+}
+
+func Test_compiler_gated(t *testing.T) {
+	tests := []struct {
+		name string
+		gate int
+		cut  int
+		tick int
+		want int
+	}{
+		{name: "full", gate: 8, tick: 480, want: 480},
+		{name: "q6", gate: 6, tick: 480, want: 360},
+		{name: "@q", gate: 8, cut: 100, tick: 480, want: 380},
+		{name: "q and @q", gate: 4, cut: 40, tick: 480, want: 200},
+		{name: "min", gate: 8, cut: 480, tick: 480, want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &compiler{gate: tt.gate, cut: tt.cut}
+			assert.Equal(t, tt.want, c.gated(tt.tick))
+		})
+	}
+}
+
+func Test_compiler_pitch(t *testing.T) {
+	tests := []struct {
+		name    string
+		ch      int
+		global  int
+		note    *mml.Note
+		want    int
+		wantErr string
+	}{
+		{name: "normal", note: &mml.Note{Key: "c"}, want: 60},
+		{name: "global", global: 3, note: &mml.Note{Key: "c"}, want: 63},
+		{name: "drum", ch: 9, global: 3, note: &mml.Note{Key: "c"}, want: 60},
+		{name: "natural", note: &mml.Note{Key: "b", Natural: true}, want: 71},
+		{name: "key", note: &mml.Note{Key: "b"}, want: 70},
+		{name: "drum key", ch: 9, note: &mml.Note{Key: "b"}, want: 71},
+		{name: "min", global: -100, note: &mml.Note{Key: "c"}, want: 0, wantErr: "0: note number -40 out of range"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newCompiler(tt.ch, 960)
+			c.global = tt.global
+			c.key = keyAccidentals(-1)
+			assert.Equal(t, tt.want, c.pitch(4, tt.note))
+			if tt.wantErr == "" {
+				assert.NoError(t, c.errs.Err())
+			} else {
+				assert.EqualError(t, c.errs.Err(), tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_compiler_onset(t *testing.T) {
+	c := newCompiler(0, 960)
+	c.bounds = []int{0, 5}
+	c.lyrics = map[int][]string{0: {"ha", "-", "py"}, 1: {"day"}}
+	seq := c.compile(parse(t, "cdef gab"))
+	got := []Event{}
+	for _, e := range seq.Events {
+		if e.Kind == Lyric {
+			got = append(got, e)
+		}
+	}
+	assert.Equal(t, []Event{
+		{Kind: Lyric, Data: []byte("ha")},
+		{Tick: 960, Kind: Lyric, Data: []byte("py")},
+		{Tick: 1920, Kind: Lyric, Data: []byte("day")},
+	}, got)
+}
+
+func Test_compiler_drum(t *testing.T) {
+	tests := []struct {
+		name    string
+		ch      int
+		drum    string
+		want    int
+		wantErr string
+	}{
+		{name: "gm", ch: 9, drum: "sd", want: 38},
+		{name: "user", ch: 9, drum: "kick", want: 35},
+		{name: "gm percussion", ch: 9, drum: "otri", want: 81},
+		{name: "user only", ch: 9, drum: "tri", want: 81},
+		{name: "unknown", ch: 9, drum: "xx", wantErr: "0: unknown drum \"xx\""},
+		{name: "not drum channel", drum: "bd", wantErr: "0: drum \"bd\" outside channel 10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newCompiler(tt.ch, 960)
+			c.drums = map[string]int{"kick": 35, "tri": 81}
+			got, ok := c.drum(&mml.Drum{Name: tt.drum})
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.wantErr == "", ok)
+			if tt.wantErr != "" {
+				assert.EqualError(t, c.errs.Err(), tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_keyAccidentals(t *testing.T) {
+	tests := []struct {
+		name string
+		sf   int
+		want map[string]int
+	}{
+		{name: "C", want: map[string]int{}},
+		{name: "D", sf: 2, want: map[string]int{"f": 1, "c": 1}},
+		{name: "Eb", sf: -3, want: map[string]int{"b": -1, "e": -1, "a": -1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, keyAccidentals(tt.sf))
+		})
+	}
+}
+
+func Test_parseKey(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want *keySignature
+	}{
+		{name: "major", src: "D", want: &keySignature{sf: 2}},
+		{name: "flat", src: "Bb", want: &keySignature{sf: -2}},
+		{name: "minor", src: "c#m", want: &keySignature{sf: 4, minor: true}},
+		{name: "mml accidental", src: "E-m", want: &keySignature{sf: -6, minor: true}},
+		{name: "invalid", src: "H"},
+		{name: "invalid minor", src: "Dbm"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, parseKey(tt.src))
+		})
+	}
+}
+
+func Test_parseTimeSignature(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want *timeSignature
+	}{
+		{name: "3/4", src: "3/4", want: &timeSignature{num: 3, den: 4}},
+		{name: "spaces", src: "7 / 8", want: &timeSignature{num: 7, den: 8}},
+		{name: "not power of 2", src: "3/6"},
+		{name: "zero", src: "0/4"},
+		{name: "no slash", src: "4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, parseTimeSignature(tt.src))
+		})
+	}
+}
+
+func Test_timeSignature_event(t *testing.T) {
+	tests := []struct {
+		name string
+		sig  timeSignature
+		tick int
+		want Event
+	}{
+		{name: "4/4", sig: timeSignature{num: 4, den: 4}, want: Event{Kind: TimeSignature, Data: []byte{0x4, 0x2, 0x18, 0x8}}},
+		{name: "7/8", sig: timeSignature{num: 7, den: 8}, tick: 960, want: Event{Tick: 960, Kind: TimeSignature, Data: []byte{0x7, 0x3, 0x18, 0x8}}},
+		{name: "2/1", sig: timeSignature{num: 2, den: 1}, want: Event{Kind: TimeSignature, Data: []byte{0x2, 0x0, 0x18, 0x8}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.sig.event(tt.tick))
+		})
+	}
+}
+
 func Test_noteNum(t *testing.T) {
 	type args struct {
 		oct  int
@@ -548,21 +1538,23 @@ func Test_noteNum(t *testing.T) {
 
 func Test_event(t *testing.T) {
 	type args struct {
-		dt  int
-		ev  int
-		n   int
-		vel int
+		tick int
+		ch   int
+		kind EventKind
+		data []int
 	}
 	tests := []struct {
 		name string
 		args args
-		want []byte
+		want Event
 	}{
-		{name: "default", want: []byte{0x0, 0x0, 0x0, 0x0}},
+		{name: "default", want: Event{Data: []byte{}}},
+		{name: "note on", args: args{tick: 480, ch: 2, kind: NoteOn, data: []int{60, 100}},
+			want: Event{Tick: 480, Channel: 2, Kind: NoteOn, Data: []byte{0x3c, 0x64}}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := event(tt.args.dt, tt.args.ev, tt.args.n, tt.args.vel)
+			got := event(tt.args.tick, tt.args.ch, tt.args.kind, tt.args.data...)
 			assert.Equal(t, tt.want, got)
 		})
 	}
@@ -570,8 +1562,11 @@ func Test_event(t *testing.T) {
 
 func Test_programChange(t *testing.T) {
 	type args struct {
-		ch int
-		p  int
+		tick int
+		ch   int
+		p    int
+		msb  int
+		lsb  int
 	}
 	tests := []struct {
 		name string
@@ -579,21 +1574,44 @@ func Test_programChange(t *testing.T) {
 		want []byte
 	}{
 		{name: "default", want: []byte{0x0, 0xb0, 0x0, 0x0, 0x0, 0xb0, 0x20, 0x0, 0x0, 0xc0, 0xff}},
+		{name: "bank", args: args{ch: 1, p: 49, msb: 8, lsb: 1}, want: []byte{0x0, 0xb1, 0x0, 0x8, 0x0, 0xb1, 0x20, 0x1, 0x0, 0xc1, 0x30}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := programChange(tt.args.ch, tt.args.p)
+			got := encode(programChange(tt.args.tick, tt.args.ch, tt.args.p, tt.args.msb, tt.args.lsb))
 			assert.Equal(t, tt.want, got)
 		})
 	}
 }
 
+func Test_pitchBend(t *testing.T) {
+	tests := []struct {
+		name string
+		v    int
+		want []byte
+	}{
+		{name: "center", v: 0, want: []byte{0x0, 0xe0, 0x0, 0x40}},
+		{name: "min", v: -8192, want: []byte{0x0, 0xe0, 0x0, 0x0}},
+		{name: "max", v: 8191, want: []byte{0x0, 0xe0, 0x7f, 0x7f}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, encode([]Event{pitchBend(0, 0, tt.v)}))
+		})
+	}
+}
+
+func Test_bendRange(t *testing.T) {
+	got := encode(bendRange(0, 1, 12))
+	assert.Equal(t, []byte{0x0, 0xb1, 0x65, 0x0, 0x0, 0xb1, 0x64, 0x0, 0x0, 0xb1, 0x6, 0xc, 0x0, 0xb1, 0x26, 0x0}, got)
+}
+
 func Test_cc(t *testing.T) {
 	type args struct {
-		dt  int
-		ch  int
-		num int
-		val int
+		tick int
+		ch   int
+		num  int
+		val  int
 	}
 	tests := []struct {
 		name string
@@ -604,7 +1622,7 @@ func Test_cc(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := cc(tt.args.dt, tt.args.ch, tt.args.num, tt.args.val)
+			got := encode([]Event{cc(tt.args.tick, tt.args.ch, tt.args.num, tt.args.val)})
 			assert.Equal(t, tt.want, got)
 		})
 	}
@@ -639,21 +1657,24 @@ func Test_itofb(t *testing.T) {
 	}
 }
 
-func Test_expand(t *testing.T) {
+func Test_clamp(t *testing.T) {
 	type args struct {
-		mml string
+		n   int
+		min int
+		max int
 	}
 	tests := []struct {
 		name string
 		args args
-		want string
+		want int
 	}{
-		{name: "normal", args: args{mml: "cde"}, want: "cde"},
-		{name: "loop", args: args{mml: "cr[cr][rd]3rd"}, want: "crcrcrrdrdrdrd"},
+		{name: "normal", args: args{n: 12, min: 1, max: 15}, want: 12},
+		{name: "min", args: args{n: 12, min: 20, max: 30}, want: 20},
+		{name: "max", args: args{n: 12, min: 1, max: 10}, want: 10},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := expand(tt.args.mml)
+			got := clamp(tt.args.n, tt.args.min, tt.args.max)
 			assert.Equal(t, tt.want, got)
 		})
 	}
@@ -694,7 +1715,7 @@ func Test_buildTitle(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := buildTitle(tt.args.title)
+			got := encode([]Event{buildTitle(tt.args.title)})
 			assert.Equal(t, tt.want, got)
 		})
 	}
@@ -702,6 +1723,7 @@ func Test_buildTitle(t *testing.T) {
 
 func Test_buildTempo(t *testing.T) {
 	type args struct {
+		tick  int
 		tempo int
 	}
 	tests := []struct {
@@ -710,11 +1732,19 @@ func Test_buildTempo(t *testing.T) {
 		want []byte
 	}{
 		{name: "120", args: args{tempo: 120}, want: []byte{0x00, 0xff, 0x51, 0x03, 0x07, 0xa1, 0x20}},
+		{name: "1", args: args{tempo: 1}, want: []byte{0x00, 0xff, 0x51, 0x03, 0xff, 0xff, 0xff}},
+		{name: "tick", args: args{tick: 480, tempo: 120}, want: []byte{0x83, 0x60, 0xff, 0x51, 0x03, 0x07, 0xa1, 0x20}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := buildTempo(tt.args.tempo)
+			got := encode([]Event{buildTempo(tt.args.tick, tt.args.tempo)})
 			assert.Equal(t, tt.want, got)
 		})
 	}
 }
+
+func parse(t *testing.T, src string) []mml.Node {
+	nodes, err := mml.Parse(src)
+	assert.NoError(t, err)
+	return nodes
+}
@@ -0,0 +1,520 @@
+package mml
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Node は構文木のノード
+type Node interface {
+	Pos() Pos
+	String() string
+}
+
+// Duration は音長 (c4. の "4." や ^8 の "8"、c%120 の "%120")
+type Duration struct {
+	At    Pos
+	Value int  // 4 で4分音符。0 は省略
+	Ticks bool // true なら Value は tick 数 (%)
+	Dot   bool
+}
+
+// Omitted は音長が省略されていれば true
+func (d Duration) Omitted() bool {
+	return d.Value == 0 && !d.Ticks
+}
+
+func (d Duration) String() string {
+	s := ""
+	if d.Ticks {
+		s = "%" + strconv.Itoa(d.Value)
+	} else if d.Value > 0 {
+		s = strconv.Itoa(d.Value)
+	}
+	if d.Dot {
+		s += "."
+	}
+	return s
+}
+
+// Note は音符 (cdefgab)
+type Note struct {
+	At         Pos
+	Key        string // "a"～"g"
+	Accidental int    // +1 で半音上げ、-1 で半音下げ
+	Natural    bool   // true なら調号を無視する (=)
+	Slide      []Node // & の後のオクターブ指定と行き先の音符 (c&>d)。音の長さをかけてベンドする
+	Accent     bool   // アクセント (')
+	Length     Duration
+	Ties       []Duration
+}
+
+// NoteNumber は音番号で指定する音符 (n60,4)。移調と調号は適用しない
+type NoteNumber struct {
+	At     Pos
+	Value  int // 0～127
+	Accent bool
+	Length Duration
+	Ties   []Duration
+}
+
+// Rest は休符 (r)
+type Rest struct {
+	At     Pos
+	Length Duration
+	Ties   []Duration
+}
+
+// Drum はドラムの音名 (*bd, *sd)。10ch で音番号に置き換える
+type Drum struct {
+	At     Pos
+	Name   string
+	Accent bool
+	Length Duration
+	Ties   []Duration
+}
+
+// Chord は和音 ({ceg})。Body は Note と NoteNumber と OctaveChange と Drum
+type Chord struct {
+	At     Pos
+	Body   []Node
+	Accent bool
+	Length Duration
+	Ties   []Duration
+}
+
+// Tuplet は連符 ({3:cde}4)
+// Body を Length の長さで演奏する。Length 省略時は Count 未満で最大の2の累乗個分の長さ
+type Tuplet struct {
+	At     Pos
+	Count  int
+	Body   []Node
+	Length Duration
+	Ties   []Duration
+}
+
+// Loop は繰り返し ([...]n)。Count は 0 で省略
+type Loop struct {
+	At    Pos
+	Body  []Node
+	Count int
+}
+
+// LoopBreak は繰り返しの最後の回に抜ける位置 ([...|...]n の "|")
+type LoopBreak struct {
+	At Pos
+}
+
+// OctaveChange はオクターブ指定 (o, >, <)
+type OctaveChange struct {
+	At       Pos
+	Value    int
+	Relative bool // true なら Value は相対値
+}
+
+// Transpose は移調 (k は絶対値、_ は相対値。半音単位)
+type Transpose struct {
+	At       Pos
+	Value    int
+	Relative bool // true なら Value は相対値
+}
+
+// KeySignature は調号 (ks)。正ならシャープ、負ならフラットの数
+type KeySignature struct {
+	At    Pos
+	Value int
+}
+
+// TimeSignature は拍子 (ts3/4)
+type TimeSignature struct {
+	At  Pos
+	Num int
+	Den int
+}
+
+// Length は省略時音長 (l)
+type Length struct {
+	At    Pos
+	Value int
+	Ticks bool // true なら Value は tick 数 (l%)
+}
+
+// Gate はゲートタイム (q は音長の n/8、@q は音長から n tick 削る)
+type Gate struct {
+	At    Pos
+	Value int
+	Ticks bool // true なら @q
+}
+
+// Velocity はベロシティ (v)。Ramp なら Length の間に Value まで段階的に変える (v~120,1)
+type Velocity struct {
+	At     Pos
+	Value  int
+	Ramp   bool
+	Length Duration
+}
+
+// VelocityStep はベロシティの相対変更 (( で下げ、) で上げる)。Value は段数
+type VelocityStep struct {
+	At    Pos
+	Value int
+}
+
+// VelocityStepSize は ( と ) の1段のベロシティ (@vs)
+type VelocityStepSize struct {
+	At    Pos
+	Value int
+}
+
+// Accent はアクセントで加えるベロシティ (@va)
+type Accent struct {
+	At    Pos
+	Value int
+}
+
+// Program は音色 (@)。MSB と LSB はバンクセレクト (@10,8,1)
+// Name は GM の音色名で指定したときの名前 (@"Acoustic Grand Piano")
+type Program struct {
+	At    Pos
+	Value int
+	Name  string
+	MSB   int
+	LSB   int
+}
+
+// Pan はパンポット (p)
+type Pan struct {
+	At    Pos
+	Value int
+}
+
+// ControlChange はコントロールチェンジ
+// y<cc>,<値> と、@v (CC7)、@x (CC11)、@s (CC64)、@m (CC1)、@r (CC91)、@c (CC93)
+// Ramp なら Length の間に Value まで段階的に変える (@x~40,1)
+type ControlChange struct {
+	At      Pos
+	Command string // "y" や "@v"
+	Number  int
+	Value   int
+	Ramp    bool
+	Length  Duration
+}
+
+// PitchBend はピッチベンド (@b)。-8192～8191
+type PitchBend struct {
+	At    Pos
+	Value int
+}
+
+// BendRange はピッチベンドの幅 (@br)。半音単位
+type BendRange struct {
+	At    Pos
+	Value int
+}
+
+// SlideSteps は & でベンドするときの段数 (@bs)
+type SlideSteps struct {
+	At    Pos
+	Value int
+}
+
+// LFO は LFO の定義 (@lv 0,48,64,1)。定義すると有効になる
+// Kind は "v" (ビブラート)、"t" (トレモロ)、"p" (オートパン)
+type LFO struct {
+	At    Pos
+	Kind  string
+	Delay int // 発音から揺らし始めるまでの tick
+	Rate  int // 1周期の tick
+	Depth int
+	Wave  int // 0:三角波 1:正弦波 2:矩形波 3:のこぎり波
+}
+
+// LFOSwitch は LFO の有効・無効の切り替え (@lv1, @lv0)
+type LFOSwitch struct {
+	At   Pos
+	Kind string
+	On   bool
+}
+
+// Swing はスウィング (@w60,16)。Percent は裏拍の位置、Unit は音長で 0 は省略 (8分音符)
+type Swing struct {
+	At      Pos
+	Percent int
+	Unit    int
+}
+
+// SysEx はシステムエクスクルーシブ (x"41 10 42 12 40 00 7F 00 41")
+// Data は先頭の F0 と末尾の F7 を除いた内容
+type SysEx struct {
+	At   Pos
+	Data []byte
+}
+
+// Marker はマーカー (m"Chorus")。Conductor に出力する
+type Marker struct {
+	At   Pos
+	Text string
+}
+
+// LoopPoint はループの開始位置 (L)。数字が続かない l
+type LoopPoint struct {
+	At Pos
+}
+
+// Tempo はテンポ (t)。Ramp なら Length の間に Value まで段階的に変える (t~180,1)
+type Tempo struct {
+	At     Pos
+	Value  int
+	Ramp   bool
+	Length Duration
+}
+
+// Channel はチャンネル ($)
+type Channel struct {
+	At    Pos
+	Value int
+}
+
+func (n *Note) Pos() Pos             { return n.At }
+func (n *NoteNumber) Pos() Pos       { return n.At }
+func (n *Rest) Pos() Pos             { return n.At }
+func (n *Drum) Pos() Pos             { return n.At }
+func (n *Chord) Pos() Pos            { return n.At }
+func (n *Tuplet) Pos() Pos           { return n.At }
+func (n *Loop) Pos() Pos             { return n.At }
+func (n *LoopBreak) Pos() Pos        { return n.At }
+func (n *OctaveChange) Pos() Pos     { return n.At }
+func (n *Transpose) Pos() Pos        { return n.At }
+func (n *KeySignature) Pos() Pos     { return n.At }
+func (n *TimeSignature) Pos() Pos    { return n.At }
+func (n *Length) Pos() Pos           { return n.At }
+func (n *Gate) Pos() Pos             { return n.At }
+func (n *Velocity) Pos() Pos         { return n.At }
+func (n *VelocityStep) Pos() Pos     { return n.At }
+func (n *VelocityStepSize) Pos() Pos { return n.At }
+func (n *Accent) Pos() Pos           { return n.At }
+func (n *Program) Pos() Pos          { return n.At }
+func (n *Pan) Pos() Pos              { return n.At }
+func (n *ControlChange) Pos() Pos    { return n.At }
+func (n *PitchBend) Pos() Pos        { return n.At }
+func (n *BendRange) Pos() Pos        { return n.At }
+func (n *SlideSteps) Pos() Pos       { return n.At }
+func (n *Swing) Pos() Pos            { return n.At }
+func (n *LFO) Pos() Pos              { return n.At }
+func (n *LFOSwitch) Pos() Pos        { return n.At }
+func (n *SysEx) Pos() Pos            { return n.At }
+func (n *Marker) Pos() Pos           { return n.At }
+func (n *LoopPoint) Pos() Pos        { return n.At }
+func (n *Tempo) Pos() Pos            { return n.At }
+func (n *Channel) Pos() Pos          { return n.At }
+
+func (n *Note) String() string {
+	s := n.Key
+	if n.Accidental > 0 {
+		s += "+"
+	} else if n.Accidental < 0 {
+		s += "-"
+	} else if n.Natural {
+		s += "="
+	}
+	if n.Accent {
+		s += "'"
+	}
+	if len(n.Slide) > 0 {
+		s += "&" + Format(n.Slide)
+	}
+	return s + durations(n.Length, n.Ties)
+}
+
+func (n *NoteNumber) String() string {
+	s := "n" + strconv.Itoa(n.Value)
+	if n.Accent {
+		s += "'"
+	}
+	if d := durations(n.Length, n.Ties); d != "" {
+		s += "," + d
+	}
+	return s
+}
+
+func (n *Rest) String() string {
+	return "r" + durations(n.Length, n.Ties)
+}
+
+func (n *Drum) String() string {
+	s := "*" + n.Name
+	if n.Accent {
+		s += "'"
+	}
+	return s + durations(n.Length, n.Ties)
+}
+
+func (n *Chord) String() string {
+	s := "{" + Format(n.Body) + "}"
+	if n.Accent {
+		s += "'"
+	}
+	return s + durations(n.Length, n.Ties)
+}
+
+func (n *Tuplet) String() string {
+	return "{" + strconv.Itoa(n.Count) + ":" + Format(n.Body) + "}" + durations(n.Length, n.Ties)
+}
+
+func (n *Loop) String() string {
+	s := "[" + Format(n.Body) + "]"
+	if n.Count > 0 {
+		s += strconv.Itoa(n.Count)
+	}
+	return s
+}
+
+func (n *LoopBreak) String() string {
+	return "|"
+}
+
+func (n *OctaveChange) String() string {
+	if !n.Relative {
+		return "o" + strconv.Itoa(n.Value)
+	}
+	if n.Value > 0 {
+		return strings.Repeat(">", n.Value)
+	}
+	return strings.Repeat("<", -n.Value)
+}
+
+func (n *Transpose) String() string {
+	if n.Relative {
+		return "_" + fmt.Sprintf("%+d", n.Value)
+	}
+	return "k" + strconv.Itoa(n.Value)
+}
+
+func (n *KeySignature) String() string { return "ks" + strconv.Itoa(n.Value) }
+
+func (n *TimeSignature) String() string {
+	return "ts" + strconv.Itoa(n.Num) + "/" + strconv.Itoa(n.Den)
+}
+
+func (n *Length) String() string     { return "l" + Duration{Value: n.Value, Ticks: n.Ticks}.String() }
+func (n *Pan) String() string        { return "p" + strconv.Itoa(n.Value) }
+func (n *Channel) String() string    { return "$" + strconv.Itoa(n.Value) }
+func (n *PitchBend) String() string  { return "@b" + strconv.Itoa(n.Value) }
+func (n *BendRange) String() string  { return "@br" + strconv.Itoa(n.Value) }
+func (n *SlideSteps) String() string { return "@bs" + strconv.Itoa(n.Value) }
+
+func (n *Program) String() string {
+	s := "@" + strconv.Itoa(n.Value)
+	if n.Name != "" {
+		s = `@"` + n.Name + `"`
+	}
+	if n.MSB > 0 || n.LSB > 0 {
+		s += "," + strconv.Itoa(n.MSB)
+	}
+	if n.LSB > 0 {
+		s += "," + strconv.Itoa(n.LSB)
+	}
+	return s
+}
+
+func (n *ControlChange) String() string {
+	if n.Command == "y" {
+		return "y" + strconv.Itoa(n.Number) + "," + strconv.Itoa(n.Value)
+	}
+	if n.Ramp {
+		return n.Command + "~" + strconv.Itoa(n.Value) + "," + n.Length.String()
+	}
+	return n.Command + strconv.Itoa(n.Value)
+}
+
+func (n *Velocity) String() string {
+	if n.Ramp {
+		return "v~" + strconv.Itoa(n.Value) + "," + n.Length.String()
+	}
+	return "v" + strconv.Itoa(n.Value)
+}
+
+func (n *VelocityStep) String() string {
+	s := ")"
+	v := n.Value
+	if v < 0 {
+		s, v = "(", -v
+	}
+	if v != 1 {
+		s += strconv.Itoa(v)
+	}
+	return s
+}
+
+func (n *VelocityStepSize) String() string { return "@vs" + strconv.Itoa(n.Value) }
+func (n *Accent) String() string           { return "@va" + strconv.Itoa(n.Value) }
+
+func (n *Swing) String() string {
+	if n.Unit > 0 {
+		return "@w" + strconv.Itoa(n.Percent) + "," + strconv.Itoa(n.Unit)
+	}
+	return "@w" + strconv.Itoa(n.Percent)
+}
+
+func (n *LFO) String() string {
+	return fmt.Sprintf("@l%s%d,%d,%d,%d", n.Kind, n.Delay, n.Rate, n.Depth, n.Wave)
+}
+
+func (n *LFOSwitch) String() string {
+	if n.On {
+		return "@l" + n.Kind + "1"
+	}
+	return "@l" + n.Kind + "0"
+}
+
+func (n *SysEx) String() string {
+	return fmt.Sprintf(`x"% X"`, n.Data)
+}
+
+func (n *Marker) String() string { return `m"` + n.Text + `"` }
+
+func (n *LoopPoint) String() string { return "L" }
+
+func (n *Tempo) String() string {
+	if n.Ramp {
+		return "t~" + strconv.Itoa(n.Value) + "," + n.Length.String()
+	}
+	return "t" + strconv.Itoa(n.Value)
+}
+
+func (n *Gate) String() string {
+	if n.Ticks {
+		return "@q" + strconv.Itoa(n.Value)
+	}
+	return "q" + strconv.Itoa(n.Value)
+}
+
+// Format は構文木を MML に戻す
+func Format(nodes []Node) string {
+	s := ""
+	for i, n := range nodes {
+		t := n.String()
+		if d, ok := prev(nodes, i).(*Drum); ok && strings.HasSuffix(s, d.Name) && t != "" && unicode.IsLetter(rune(t[0])) {
+			s += " " // ドラムの音名が次のコマンドとつながらないよう空白で区切る
+		}
+		s += t
+	}
+	return s
+}
+
+func prev(nodes []Node, i int) Node {
+	if i == 0 {
+		return nil
+	}
+	return nodes[i-1]
+}
+
+func durations(d Duration, ties []Duration) string {
+	s := d.String()
+	for _, t := range ties {
+		s += "^" + t.String()
+	}
+	return s
+}
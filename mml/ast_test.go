@@ -0,0 +1,50 @@
+package mml
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{name: "empty", src: "", want: ""},
+		{name: "normal", src: "@10 L8 O4 c D# e-4.^8 r2", want: "@10l8o4cd+e-4.^8r2"},
+		{name: "chord", src: "{c>c<}4.", want: "{c>c<}4."},
+		{name: "loop", src: "[c[de]3]", want: "[c[de]3]"},
+		{name: "tuplet", src: "{3: c d {ce}}4^8", want: "{3:cd{ce}}4^8"},
+		{name: "loop break", src: "[c | d]3", want: "[c|d]3"},
+		{name: "key and transpose", src: "k-2 _1 ks-3 c= b", want: "k-2_+1ks-3c=b"},
+		{name: "control change", src: "@V100 @m 3 y 1, 2", want: "@v100@m3y1,2"},
+		{name: "bend", src: "@b-100 @br12 @bs8 c & > d 4", want: "@b-100@br12@bs8c&>d4"},
+		{name: "lfo", src: "@lv 10, 240, 100 @lt1 @lp0", want: "@lv10,240,100,0@lt1@lp0"},
+		{name: "velocity", src: "( )2 @vs4 @va10 c' {ce}' v~100,2 @x~0,%10", want: "()2@vs4@va10c'{ce}'v~100,2@x~0,%10"},
+		{name: "swing", src: "@w 60 @w66, 16", want: "@w60@w66,16"},
+		{name: "tempo ramp", src: "t~ 90 , %960 t~120,", want: "t~90,%960t~120,"},
+		{name: "drum", src: "*BD4 *sd'^8 {*bd *hh}", want: "*bd4*sd'^8{*bd*hh}"},
+		{name: "drum separator", src: "*bd c *hh r *sd L *ride' c {*bd e}", want: "*bd c*hh r*sd L*ride'c{*bd e}"},
+		{name: "note number", src: "N60 ,4.^8 n0' {n36 n42}", want: "n60,4.^8n0'{n36n42}"},
+		{name: "program", src: `@ 49 , 8 @"Flute" , 0 , 1 @10,0,0`, want: `@49,8@"Flute",0,1@10`},
+		{name: "sysex", src: `x "f0 7e 7f 09 01 f7"`, want: `x"7E 7F 09 01"`},
+		{name: "marker", src: `m "Intro" c`, want: `m"Intro"c`},
+		{name: "loop point", src: "L c l8", want: "Lcl8"},
+		{name: "time signature", src: "ts 7/8 c", want: "ts7/8c"},
+		{name: "tick length", src: "l%240 c%100.^%20 {ce}%7", want: "l%240c%100.^%20{ce}%7"},
+		{name: "commands", src: "v100p64t120$10q7@Q12", want: "v100p64t120$10q7@q12"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes, err := Parse(tt.src)
+			assert.NoError(t, err)
+			got := Format(nodes)
+			assert.Equal(t, tt.want, got)
+			again, err := Parse(got)
+			assert.NoError(t, err)
+			assert.Equal(t, got, Format(again), "re-parse")
+		})
+	}
+}
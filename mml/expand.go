@@ -0,0 +1,53 @@
+package mml
+
+// Expand は繰り返しを展開した構文木を返す
+// 最後の回は LoopBreak の手前で繰り返しを抜ける
+func Expand(nodes []Node) []Node {
+	res := []Node{}
+	for _, n := range nodes {
+		if t, ok := n.(*Tuplet); ok {
+			e := *t
+			e.Body = Expand(t.Body)
+			res = append(res, &e)
+			continue
+		}
+		lp, ok := n.(*Loop)
+		if !ok {
+			res = append(res, n)
+			continue
+		}
+		body := Expand(lp.Body)
+		for i := 0; i < lp.Times(); i++ {
+			for _, b := range body {
+				if _, ok := b.(*LoopBreak); ok {
+					if i == lp.Times()-1 {
+						break
+					}
+					continue
+				}
+				res = append(res, b)
+			}
+		}
+	}
+	return res
+}
+
+// Base は Length 省略時に何個分の長さで演奏するかを返す (3連符なら2)
+func (n *Tuplet) Base() int {
+	b := 1
+	for b*2 < n.Count {
+		b *= 2
+	}
+	return b
+}
+
+// Times は繰り返し回数を返す。省略時は2回、上限は128回
+func (n *Loop) Times() int {
+	if n.Count == 0 {
+		return 2
+	}
+	if n.Count > 128 {
+		return 128
+	}
+	return n.Count
+}
@@ -0,0 +1,58 @@
+package mml
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpand(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{name: "normal", src: "cde", want: "cde"},
+		{name: "loop", src: "cr[cr][rd]3rd", want: "crcrcrrdrdrdrd"},
+		{name: "space", src: "c d [e]", want: "cdee"},
+		{name: "nest", src: "[c[d]3]2", want: "cdddcddd"},
+		{name: "nest3", src: "[a[b[c]3d]2e]2", want: "abcccdbcccde" + "abcccdbcccde"},
+		{name: "nest3 sequence", src: "[[[c]2d]2]2e[f]", want: "ccdccd" + "ccdccd" + "eff"},
+		{name: "break", src: "[cd|ef]3", want: "cdefcdefcd"},
+		{name: "break first", src: "[|c]3", want: "cc"},
+		{name: "break nest", src: "[a[b|c]2|d]2", want: "abcbd" + "abcb"},
+		{name: "break once", src: "[c|d]1", want: "c"},
+		{name: "tuplet", src: "[{3:[c]3}4]2", want: "{3:ccc}4{3:ccc}4"},
+		{name: "max", src: "[c]200", want: strings.Repeat("c", 128)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes, err := Parse(tt.src)
+			assert.NoError(t, err)
+			got := Format(Expand(nodes))
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestTuplet_Base(t *testing.T) {
+	tests := []struct {
+		name  string
+		count int
+		want  int
+	}{
+		{name: "1", count: 1, want: 1},
+		{name: "3", count: 3, want: 2},
+		{name: "4", count: 4, want: 2},
+		{name: "5", count: 5, want: 4},
+		{name: "7", count: 7, want: 4},
+		{name: "9", count: 9, want: 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := (&Tuplet{Count: tt.count}).Base()
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
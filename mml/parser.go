@@ -0,0 +1,725 @@
+package mml
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Error は構文エラー
+type Error struct {
+	Pos Pos
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d: %s", e.Pos, e.Msg)
+}
+
+// ErrorList は収集した構文エラーの一覧
+type ErrorList []*Error
+
+func (l ErrorList) Error() string {
+	msgs := []string{}
+	for _, e := range l {
+		msgs = append(msgs, e.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Err は一覧が空なら nil を返す
+func (l ErrorList) Err() error {
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
+
+// controllers は @ に続く文字とコントロールチェンジの番号
+var controllers = map[string]int{
+	"v": 7,  // Volume
+	"x": 11, // Expression
+	"s": 64, // Sustain
+	"m": 1,  // Modulation
+	"r": 91, // Reverb
+	"c": 93, // Chorus
+}
+
+type parser struct {
+	toks []Token
+	i    int
+	errs ErrorList
+}
+
+// Parse は MML を構文木に変換する
+// エラーがあっても解釈できた部分の構文木を返し、エラーは位置順の ErrorList にまとめて返す
+func Parse(src string) ([]Node, error) {
+	p := &parser{toks: Tokenize(src)}
+	nodes := p.parseNodes("")
+	sort.SliceStable(p.errs, func(i, j int) bool { return p.errs[i].Pos < p.errs[j].Pos })
+	return nodes, p.errs.Err()
+}
+
+func (p *parser) peek() Token {
+	return p.toks[p.i]
+}
+
+func (p *parser) next() Token {
+	t := p.toks[p.i]
+	if t.Kind != EOF {
+		p.i++
+	}
+	return t
+}
+
+// is は次のトークンが記号 s なら true
+func (p *parser) is(s string) bool {
+	t := p.peek()
+	return t.Kind == Char && t.Text == s
+}
+
+func (p *parser) errorf(pos Pos, format string, a ...interface{}) {
+	p.errs = append(p.errs, &Error{Pos: pos, Msg: fmt.Sprintf(format, a...)})
+}
+
+// parseNodes は EOF まで(end を指定したら end の手前まで)を解析する
+func (p *parser) parseNodes(end string) []Node {
+	nodes := []Node{}
+	for {
+		t := p.peek()
+		if t.Kind == EOF {
+			return nodes
+		}
+		if t.Kind == Number {
+			p.next()
+			p.errorf(t.Pos, "unexpected number %s", t.Text)
+			continue
+		}
+		if t.Kind == String {
+			p.next()
+			p.errorf(t.Pos, "unexpected string %s", t.Text)
+			continue
+		}
+		if t.Kind == Char && t.Text == end {
+			return nodes
+		}
+		if t.Text == "|" {
+			p.next()
+			if end != "]" {
+				p.errorf(t.Pos, "'|' outside loop")
+				continue
+			}
+			nodes = append(nodes, &LoopBreak{At: t.Pos})
+			continue
+		}
+		if n := p.parseNode(); n != nil {
+			nodes = append(nodes, n)
+		}
+	}
+}
+
+func (p *parser) parseNode() Node {
+	t := p.next()
+	switch t.Text {
+	case "a", "b", "c", "d", "e", "f", "g":
+		n := &Note{At: t.Pos, Key: t.Text}
+		p.parseAccidental(n)
+		if p.is("'") {
+			p.next()
+			n.Accent = true
+		}
+		if p.is("&") {
+			n.Slide = p.parseSlide(p.next())
+		}
+		n.Length, n.Ties = p.parseDurations(t.Pos)
+		return n
+	case "n":
+		n := p.parseNoteNumber(t)
+		if n == nil {
+			return nil
+		}
+		if p.is(",") {
+			n.Length, n.Ties = p.parseDurations(p.next().Pos)
+		}
+		return n
+	case "r":
+		n := &Rest{At: t.Pos}
+		n.Length, n.Ties = p.parseDurations(t.Pos)
+		return n
+	case "*":
+		n := p.parseDrum(t)
+		if n == nil {
+			return nil
+		}
+		n.Length, n.Ties = p.parseDurations(t.Pos)
+		return n
+	case "{":
+		return p.parseChord(t)
+	case "[":
+		n := &Loop{At: t.Pos, Body: p.parseNodes("]")}
+		if !p.is("]") {
+			p.errorf(t.Pos, "unclosed '['")
+			return n
+		}
+		p.next()
+		if c := p.peek(); c.Kind == Number {
+			n.Count, _ = p.number()
+			if n.Count < 1 {
+				p.errorf(c.Pos, "invalid loop count %s", c.Text)
+				n.Count = 0
+			}
+		}
+		return n
+	case "]":
+		p.errorf(t.Pos, "unmatched ']'")
+		p.number()
+	case "}":
+		p.errorf(t.Pos, "unmatched '}'")
+	case "o":
+		if v, ok := p.argument(t); ok {
+			return &OctaveChange{At: t.Pos, Value: v}
+		}
+	case ">":
+		return &OctaveChange{At: t.Pos, Value: 1, Relative: true}
+	case "<":
+		return &OctaveChange{At: t.Pos, Value: -1, Relative: true}
+	case "k":
+		if p.is("s") {
+			s := p.next()
+			if v, ok := p.signed(s); ok {
+				return &KeySignature{At: t.Pos, Value: v}
+			}
+			return nil
+		}
+		if v, ok := p.signed(t); ok {
+			return &Transpose{At: t.Pos, Value: v}
+		}
+	case "_":
+		if v, ok := p.signed(t); ok {
+			return &Transpose{At: t.Pos, Value: v, Relative: true}
+		}
+	case "l":
+		if p.is("%") {
+			pct := p.next()
+			if v, ok := p.argument(pct); ok {
+				return &Length{At: t.Pos, Value: v, Ticks: true}
+			}
+			return nil
+		}
+		if p.peek().Kind != Number {
+			return &LoopPoint{At: t.Pos}
+		}
+		if v, ok := p.argument(t); ok {
+			return &Length{At: t.Pos, Value: v}
+		}
+	case "v":
+		if p.is("~") {
+			if v, d, ok := p.parseRamp(t, p.next(), "velocity"); ok {
+				return &Velocity{At: t.Pos, Value: v, Ramp: true, Length: d}
+			}
+			return nil
+		}
+		if v, ok := p.argument(t); ok {
+			return &Velocity{At: t.Pos, Value: v}
+		}
+	case "(", ")":
+		n := &VelocityStep{At: t.Pos, Value: 1}
+		if c := p.peek(); c.Kind == Number {
+			n.Value, _ = p.number()
+		}
+		if t.Text == "(" {
+			n.Value = -n.Value
+		}
+		return n
+	case "q":
+		if v, ok := p.argument(t); ok {
+			return &Gate{At: t.Pos, Value: v}
+		}
+	case "@":
+		if p.is("v") && p.toks[p.i+1].Kind == Char && (p.toks[p.i+1].Text == "s" || p.toks[p.i+1].Text == "a") {
+			p.next()
+			c := p.next()
+			v, ok := p.argument(c)
+			if !ok {
+				return nil
+			}
+			if c.Text == "s" {
+				return &VelocityStepSize{At: t.Pos, Value: v}
+			}
+			return &Accent{At: t.Pos, Value: v}
+		}
+		if num, ok := controllers[p.peek().Text]; ok && p.peek().Kind == Char {
+			c := p.next()
+			if p.is("~") {
+				if v, d, ok := p.parseRamp(t, p.next(), "control change"); ok {
+					return &ControlChange{At: t.Pos, Command: "@" + c.Text, Number: num, Value: v, Ramp: true, Length: d}
+				}
+				return nil
+			}
+			if v, ok := p.argument(c); ok {
+				return &ControlChange{At: t.Pos, Command: "@" + c.Text, Number: num, Value: v}
+			}
+			return nil
+		}
+		if p.is("b") {
+			return p.parseBend(t, p.next())
+		}
+		if p.is("l") {
+			return p.parseLFO(t, p.next())
+		}
+		if p.is("w") {
+			w := p.next()
+			n := &Swing{At: t.Pos}
+			v, ok := p.argument(w)
+			if !ok {
+				return nil
+			}
+			n.Percent = v
+			if p.is(",") {
+				if n.Unit, ok = p.argument(p.next()); !ok {
+					return nil
+				}
+			}
+			return n
+		}
+		if p.is("q") {
+			q := p.next()
+			if v, ok := p.argument(q); ok {
+				return &Gate{At: t.Pos, Value: v, Ticks: true}
+			}
+			return nil
+		}
+		return p.parseProgram(t)
+	case "x":
+		return p.parseSysEx(t)
+	case "m":
+		if text, ok := p.str(t); ok {
+			return &Marker{At: t.Pos, Text: text}
+		}
+	case "y":
+		num, ok := p.argument(t)
+		if !ok {
+			return nil
+		}
+		if !p.is(",") {
+			p.errorf(t.Pos, "missing ',' in y")
+			return nil
+		}
+		if v, ok := p.argument(p.next()); ok {
+			return &ControlChange{At: t.Pos, Command: "y", Number: num, Value: v}
+		}
+	case "p":
+		if v, ok := p.argument(t); ok {
+			return &Pan{At: t.Pos, Value: v}
+		}
+	case "t":
+		if p.is("s") {
+			return p.parseTimeSignature(t, p.next())
+		}
+		if p.is("~") {
+			if v, d, ok := p.parseRamp(t, p.next(), "tempo"); ok {
+				return &Tempo{At: t.Pos, Value: v, Ramp: true, Length: d}
+			}
+			return nil
+		}
+		if v, ok := p.argument(t); ok {
+			return &Tempo{At: t.Pos, Value: v}
+		}
+	case "$":
+		if v, ok := p.argument(t); ok {
+			return &Channel{At: t.Pos, Value: v}
+		}
+	default:
+		p.errorf(t.Pos, "unknown command %q", t.Text)
+	}
+	return nil
+}
+
+func (p *parser) parseChord(brace Token) Node {
+	if p.peek().Kind == Number {
+		return p.parseTuplet(brace)
+	}
+	n := &Chord{At: brace.Pos, Body: []Node{}}
+	for {
+		t := p.peek()
+		if t.Kind == EOF {
+			p.errorf(brace.Pos, "unclosed '{'")
+			return nil
+		}
+		p.next()
+		switch {
+		case t.Text == "}":
+			if p.is("'") {
+				p.next()
+				n.Accent = true
+			}
+			n.Length, n.Ties = p.parseDurations(brace.Pos)
+			return n
+		case t.Text == ">":
+			n.Body = append(n.Body, &OctaveChange{At: t.Pos, Value: 1, Relative: true})
+		case t.Text == "<":
+			n.Body = append(n.Body, &OctaveChange{At: t.Pos, Value: -1, Relative: true})
+		case t.Kind == Char && t.Text >= "a" && t.Text <= "g":
+			cn := &Note{At: t.Pos, Key: t.Text, Length: Duration{At: t.Pos}}
+			p.parseAccidental(cn)
+			if p.is("'") {
+				p.next()
+				cn.Accent = true
+			}
+			n.Body = append(n.Body, cn)
+		case t.Text == "n":
+			if nn := p.parseNoteNumber(t); nn != nil {
+				n.Body = append(n.Body, nn)
+			}
+		case t.Text == "*":
+			if d := p.parseDrum(t); d != nil {
+				d.Length = Duration{At: t.Pos}
+				n.Body = append(n.Body, d)
+			}
+		default:
+			p.errorf(t.Pos, "invalid note %q in chord", t.Text)
+		}
+	}
+}
+
+// parseProgram は音色 (@10、@10,8,1、@"Acoustic Grand Piano",8) を解析する
+func (p *parser) parseProgram(t Token) Node {
+	n := &Program{At: t.Pos}
+	if s := p.peek(); s.Kind == String {
+		p.next()
+		name, ok := p.unquote(s)
+		if !ok {
+			return nil
+		}
+		if n.Value, ok = instrument(name); !ok {
+			p.errorf(s.Pos, "unknown instrument %q", name)
+			return nil
+		}
+		n.Name = name
+	} else {
+		v, ok := p.argument(t)
+		if !ok {
+			return nil
+		}
+		n.Value = v
+	}
+	for _, bank := range []*int{&n.MSB, &n.LSB} {
+		if !p.is(",") {
+			break
+		}
+		c := p.next()
+		v, ok := p.argument(c)
+		if !ok {
+			return nil
+		}
+		if v > 127 {
+			p.errorf(c.Pos, "invalid bank %d", v)
+			return nil
+		}
+		*bank = v
+	}
+	return n
+}
+
+// parseSysEx は16進数で書いたシステムエクスクルーシブ (x"F0 41 10 42 F7") を解析する
+// 先頭の F0 と末尾の F7 は省略できる
+func (p *parser) parseSysEx(t Token) Node {
+	s := p.peek()
+	text, ok := p.str(t)
+	if !ok {
+		return nil
+	}
+	data, err := hex.DecodeString(strings.Join(strings.Fields(text), ""))
+	if err != nil {
+		p.errorf(s.Pos, "invalid SysEx %q", text)
+		return nil
+	}
+	if len(data) > 0 && data[0] == 0xF0 {
+		data = data[1:]
+	}
+	if len(data) > 0 && data[len(data)-1] == 0xF7 {
+		data = data[:len(data)-1]
+	}
+	for _, b := range data {
+		if b > 0x7F {
+			p.errorf(s.Pos, "invalid SysEx byte %02X", b)
+			return nil
+		}
+	}
+	return &SysEx{At: t.Pos, Data: data}
+}
+
+// str はコマンド cmd の文字列引数を読む
+func (p *parser) str(cmd Token) (string, bool) {
+	s := p.peek()
+	if s.Kind != String {
+		p.errorf(cmd.Pos, "missing string after %q", cmd.Text)
+		return "", false
+	}
+	p.next()
+	return p.unquote(s)
+}
+
+// unquote は String のトークンから " を除く
+func (p *parser) unquote(s Token) (string, bool) {
+	if len(s.Text) < 2 || !strings.HasSuffix(s.Text, `"`) {
+		p.errorf(s.Pos, "unterminated string")
+		return "", false
+	}
+	return s.Text[1 : len(s.Text)-1], true
+}
+
+// parseNoteNumber は n に続く音番号とアクセントを解析する
+func (p *parser) parseNoteNumber(t Token) *NoteNumber {
+	v, ok := p.argument(t)
+	if !ok {
+		return nil
+	}
+	if v > 127 {
+		p.errorf(t.Pos, "invalid note number %d", v)
+		return nil
+	}
+	n := &NoteNumber{At: t.Pos, Value: v, Length: Duration{At: t.Pos}}
+	if p.is("'") {
+		p.next()
+		n.Accent = true
+	}
+	return n
+}
+
+// parseDrum は * に続くドラムの音名とアクセントを解析する
+// 音名は空白を挟まずに続く英字 (*bd4 は bd の4分音符)
+func (p *parser) parseDrum(star Token) *Drum {
+	n := &Drum{At: star.Pos}
+	end := star.Pos + 1
+	for t := p.peek(); t.Kind == Char && t.Pos == end && t.Text >= "a" && t.Text <= "z"; t = p.peek() {
+		n.Name += p.next().Text
+		end++
+	}
+	if n.Name == "" {
+		p.errorf(star.Pos, "missing drum name after '*'")
+		return nil
+	}
+	if p.is("'") {
+		p.next()
+		n.Accent = true
+	}
+	return n
+}
+
+// parseTuplet は連符 ({3:cde}4) を解析する
+func (p *parser) parseTuplet(brace Token) Node {
+	c := p.peek()
+	n := &Tuplet{At: brace.Pos}
+	n.Count, _ = p.number()
+	if n.Count < 1 {
+		p.errorf(c.Pos, "invalid tuplet count %s", c.Text)
+		n.Count = 1
+	}
+	if !p.is(":") {
+		p.errorf(c.Pos, "missing ':' after tuplet count")
+	} else {
+		p.next()
+	}
+	n.Body = p.parseNodes("}")
+	if !p.is("}") {
+		p.errorf(brace.Pos, "unclosed '{'")
+		return n
+	}
+	p.next()
+	n.Length, n.Ties = p.parseDurations(brace.Pos)
+	return n
+}
+
+// parseTimeSignature は拍子 (ts3/4) を解析する。分母は 1～64 の2の累乗
+func (p *parser) parseTimeSignature(t, s Token) Node {
+	num, ok := p.argument(s)
+	if !ok {
+		return nil
+	}
+	if !p.is("/") {
+		p.errorf(t.Pos, "missing '/' in time signature")
+		return nil
+	}
+	den, ok := p.argument(p.next())
+	if !ok {
+		return nil
+	}
+	if num < 1 || num > 255 || den < 1 || den > 64 || den&(den-1) != 0 {
+		p.errorf(t.Pos, "invalid time signature %d/%d", num, den)
+		return nil
+	}
+	return &TimeSignature{At: t.Pos, Num: num, Den: den}
+}
+
+// parseSlide は & の後のオクターブ指定と行き先の音符を解析する
+func (p *parser) parseSlide(amp Token) []Node {
+	nodes := []Node{}
+	for {
+		t := p.peek()
+		switch {
+		case t.Text == ">":
+			p.next()
+			nodes = append(nodes, &OctaveChange{At: t.Pos, Value: 1, Relative: true})
+		case t.Text == "<":
+			p.next()
+			nodes = append(nodes, &OctaveChange{At: t.Pos, Value: -1, Relative: true})
+		case t.Kind == Char && t.Text >= "a" && t.Text <= "g":
+			p.next()
+			n := &Note{At: t.Pos, Key: t.Text, Length: Duration{At: t.Pos}}
+			p.parseAccidental(n)
+			return append(nodes, n)
+		default:
+			p.errorf(amp.Pos, "missing note after '&'")
+			return nil
+		}
+	}
+}
+
+// parseBend はピッチベンド (@b)、ベンド幅 (@br)、スライドの段数 (@bs) を解析する
+func (p *parser) parseBend(t, b Token) Node {
+	if p.is("r") {
+		if v, ok := p.argument(p.next()); ok {
+			return &BendRange{At: t.Pos, Value: v}
+		}
+		return nil
+	}
+	if p.is("s") {
+		if v, ok := p.argument(p.next()); ok {
+			return &SlideSteps{At: t.Pos, Value: v}
+		}
+		return nil
+	}
+	if v, ok := p.signed(b); ok {
+		return &PitchBend{At: t.Pos, Value: v}
+	}
+	return nil
+}
+
+// parseLFO は LFO の定義 (@lv delay,rate,depth[,wave]) と切り替え (@lv1) を解析する
+func (p *parser) parseLFO(t, l Token) Node {
+	k := p.next()
+	if k.Text != "v" && k.Text != "t" && k.Text != "p" {
+		p.errorf(k.Pos, "unknown LFO %q", k.Text)
+		return nil
+	}
+	args := []int{}
+	v, ok := p.argument(k)
+	if !ok {
+		return nil
+	}
+	args = append(args, v)
+	for p.is(",") {
+		v, ok := p.argument(p.next())
+		if !ok {
+			return nil
+		}
+		args = append(args, v)
+	}
+	switch len(args) {
+	case 1:
+		return &LFOSwitch{At: t.Pos, Kind: k.Text, On: args[0] != 0}
+	case 3, 4:
+		n := &LFO{At: t.Pos, Kind: k.Text, Delay: args[0], Rate: args[1], Depth: args[2]}
+		if len(args) == 4 {
+			n.Wave = args[3]
+		}
+		return n
+	}
+	p.errorf(t.Pos, "LFO needs delay,rate,depth[,wave]")
+	return nil
+}
+
+// parseRamp は段階的な変更 (t~180,1 の "~" 以降) の値と長さを解析する
+func (p *parser) parseRamp(t, tilde Token, name string) (int, Duration, bool) {
+	v, ok := p.argument(tilde)
+	if !ok {
+		return 0, Duration{}, false
+	}
+	if !p.is(",") {
+		p.errorf(t.Pos, "missing ',' in %s ramp", name)
+		return 0, Duration{}, false
+	}
+	comma := p.next()
+	return v, p.parseDuration(comma.Pos), true
+}
+
+func (p *parser) parseAccidental(n *Note) {
+	switch {
+	case p.is("+"):
+		n.Accidental = 1
+	case p.is("-"):
+		n.Accidental = -1
+	case p.is("="):
+		n.Natural = true
+	default:
+		return
+	}
+	p.next()
+}
+
+// parseDurations は音長とタイを解析する。省略時の位置は at
+func (p *parser) parseDurations(at Pos) (Duration, []Duration) {
+	d := p.parseDuration(at)
+	var ties []Duration
+	for p.is("^") {
+		ties = append(ties, p.parseDuration(p.next().Pos))
+	}
+	return d, ties
+}
+
+func (p *parser) parseDuration(at Pos) Duration {
+	d := Duration{At: at}
+	if p.is("%") {
+		pct := p.next()
+		d.At = pct.Pos
+		d.Value, d.Ticks = p.argument(pct)
+	} else if t := p.peek(); t.Kind == Number {
+		d.At = t.Pos
+		d.Value, _ = p.number()
+	}
+	if p.is(".") {
+		p.next()
+		d.Dot = true
+	}
+	return d
+}
+
+// number は次のトークンが数字なら読み進めてその値を返す
+func (p *parser) number() (int, bool) {
+	t := p.peek()
+	if t.Kind != Number {
+		return 0, false
+	}
+	p.next()
+	v, err := strconv.Atoi(t.Text)
+	if err != nil {
+		p.errorf(t.Pos, "invalid number %s", t.Text)
+		return 0, false
+	}
+	return v, true
+}
+
+// argument はコマンド cmd の数値引数を読む
+func (p *parser) argument(cmd Token) (int, bool) {
+	if p.peek().Kind != Number {
+		p.errorf(cmd.Pos, "missing number after %q", cmd.Text)
+		return 0, false
+	}
+	return p.number()
+}
+
+// signed はコマンド cmd の符号付きの数値引数を読む
+func (p *parser) signed(cmd Token) (int, bool) {
+	sign := 1
+	if p.is("+") {
+		p.next()
+	} else if p.is("-") {
+		p.next()
+		sign = -1
+	}
+	v, ok := p.argument(cmd)
+	return sign * v, ok
+}
@@ -0,0 +1,259 @@
+package mml
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		want    []Node
+		wantErr string
+	}{
+		{name: "empty", src: "", want: []Node{}},
+		{name: "note", src: "c d+4 e-8.^16^.", want: []Node{
+			&Note{At: 0, Key: "c", Length: Duration{At: 0}},
+			&Note{At: 2, Key: "d", Accidental: 1, Length: Duration{At: 4, Value: 4}},
+			&Note{At: 6, Key: "e", Accidental: -1, Length: Duration{At: 8, Value: 8, Dot: true},
+				Ties: []Duration{{At: 11, Value: 16}, {At: 13, Dot: true}}},
+		}},
+		{name: "rest", src: "r2", want: []Node{
+			&Rest{At: 0, Length: Duration{At: 1, Value: 2}},
+		}},
+		{name: "chord", src: "{c+e>g}4", want: []Node{
+			&Chord{At: 0, Body: []Node{
+				&Note{At: 1, Key: "c", Accidental: 1, Length: Duration{At: 1}},
+				&Note{At: 3, Key: "e", Length: Duration{At: 3}},
+				&OctaveChange{At: 4, Value: 1, Relative: true},
+				&Note{At: 5, Key: "g", Length: Duration{At: 5}},
+			}, Length: Duration{At: 7, Value: 4}},
+		}},
+		{name: "tuplet", src: "{3:c{ce}r}4.", want: []Node{
+			&Tuplet{At: 0, Count: 3, Body: []Node{
+				&Note{At: 3, Key: "c", Length: Duration{At: 3}},
+				&Chord{At: 4, Body: []Node{
+					&Note{At: 5, Key: "c", Length: Duration{At: 5}},
+					&Note{At: 6, Key: "e", Length: Duration{At: 6}},
+				}, Length: Duration{At: 4}},
+				&Rest{At: 8, Length: Duration{At: 8}},
+			}, Length: Duration{At: 10, Value: 4, Dot: true}},
+		}},
+		{name: "loop", src: "[c[d]]3", want: []Node{
+			&Loop{At: 0, Body: []Node{
+				&Note{At: 1, Key: "c", Length: Duration{At: 1}},
+				&Loop{At: 2, Body: []Node{&Note{At: 3, Key: "d", Length: Duration{At: 3}}}},
+			}, Count: 3},
+		}},
+		{name: "loop break", src: "[c|d]", want: []Node{
+			&Loop{At: 0, Body: []Node{
+				&Note{At: 1, Key: "c", Length: Duration{At: 1}},
+				&LoopBreak{At: 2},
+				&Note{At: 3, Key: "d", Length: Duration{At: 3}},
+			}},
+		}},
+		{name: "commands", src: "o4><l8v100@1p64t120$10", want: []Node{
+			&OctaveChange{At: 0, Value: 4},
+			&OctaveChange{At: 2, Value: 1, Relative: true},
+			&OctaveChange{At: 3, Value: -1, Relative: true},
+			&Length{At: 4, Value: 8},
+			&Velocity{At: 6, Value: 100},
+			&Program{At: 10, Value: 1},
+			&Pan{At: 12, Value: 64},
+			&Tempo{At: 15, Value: 120},
+			&Channel{At: 19, Value: 10},
+		}},
+		{name: "gate", src: "q6@q10", want: []Node{
+			&Gate{At: 0, Value: 6},
+			&Gate{At: 2, Value: 10, Ticks: true},
+		}},
+		{name: "missing gate", src: "@q", want: []Node{}, wantErr: `1: missing number after "q"`},
+		{name: "unknown command", src: "cjd", want: []Node{
+			&Note{At: 0, Key: "c", Length: Duration{At: 0}},
+			&Note{At: 2, Key: "d", Length: Duration{At: 2}},
+		}, wantErr: `1: unknown command "j"`},
+		{name: "unclosed chord", src: "c{eg", want: []Node{
+			&Note{At: 0, Key: "c", Length: Duration{At: 0}},
+		}, wantErr: "1: unclosed '{'"},
+		{name: "invalid chord note", src: "{cre}", want: []Node{
+			&Chord{At: 0, Body: []Node{
+				&Note{At: 1, Key: "c", Length: Duration{At: 1}},
+				&Note{At: 3, Key: "e", Length: Duration{At: 3}},
+			}, Length: Duration{At: 0}},
+		}, wantErr: `2: invalid note "r" in chord`},
+		{name: "unmatched", src: "c]2d", want: []Node{
+			&Note{At: 0, Key: "c", Length: Duration{At: 0}},
+			&Note{At: 3, Key: "d", Length: Duration{At: 3}},
+		}, wantErr: "1: unmatched ']'"},
+		{name: "unclosed loop", src: "c[d", want: []Node{
+			&Note{At: 0, Key: "c", Length: Duration{At: 0}},
+			&Loop{At: 1, Body: []Node{&Note{At: 2, Key: "d", Length: Duration{At: 2}}}},
+		}, wantErr: "1: unclosed '['"},
+		{name: "break outside loop", src: "c|d", want: []Node{
+			&Note{At: 0, Key: "c", Length: Duration{At: 0}},
+			&Note{At: 2, Key: "d", Length: Duration{At: 2}},
+		}, wantErr: "1: '|' outside loop"},
+		{name: "tuplet without colon", src: "{3c}", want: []Node{
+			&Tuplet{At: 0, Count: 3, Body: []Node{&Note{At: 2, Key: "c", Length: Duration{At: 2}}}, Length: Duration{At: 0}},
+		}, wantErr: "1: missing ':' after tuplet count"},
+		{name: "unclosed tuplet", src: "{3:c", want: []Node{
+			&Tuplet{At: 0, Count: 3, Body: []Node{&Note{At: 3, Key: "c", Length: Duration{At: 3}}}},
+		}, wantErr: "0: unclosed '{'"},
+		{name: "unmatched brace", src: "c}", want: []Node{
+			&Note{At: 0, Key: "c", Length: Duration{At: 0}},
+		}, wantErr: "1: unmatched '}'"},
+		{name: "missing number", src: "o", want: []Node{}, wantErr: `0: missing number after "o"`},
+		{name: "unexpected number", src: "8c", want: []Node{
+			&Note{At: 1, Key: "c", Length: Duration{At: 1}},
+		}, wantErr: "0: unexpected number 8"},
+		{name: "tick length", src: "c%100.^%20 l%240", want: []Node{
+			&Note{At: 0, Key: "c", Length: Duration{At: 1, Value: 100, Ticks: true, Dot: true}, Ties: []Duration{{At: 7, Value: 20, Ticks: true}}},
+			&Length{At: 11, Value: 240, Ticks: true},
+		}},
+		{name: "missing tick length", src: "c%", want: []Node{
+			&Note{At: 0, Key: "c", Length: Duration{At: 1}},
+		}, wantErr: `1: missing number after "%"`},
+		{name: "key and transpose", src: "k-2_+1ks-3c={c=e}", want: []Node{
+			&Transpose{At: 0, Value: -2},
+			&Transpose{At: 3, Value: 1, Relative: true},
+			&KeySignature{At: 6, Value: -3},
+			&Note{At: 10, Key: "c", Natural: true, Length: Duration{At: 10}},
+			&Chord{At: 12, Body: []Node{
+				&Note{At: 13, Key: "c", Natural: true, Length: Duration{At: 13}},
+				&Note{At: 15, Key: "e", Length: Duration{At: 15}},
+			}, Length: Duration{At: 12}},
+		}},
+		{name: "missing transpose", src: "_c", want: []Node{
+			&Note{At: 1, Key: "c", Length: Duration{At: 1}},
+		}, wantErr: `0: missing number after "_"`},
+		{name: "time signature", src: "ts3/4 t120", want: []Node{
+			&TimeSignature{At: 0, Num: 3, Den: 4},
+			&Tempo{At: 6, Value: 120},
+		}},
+		{name: "control change", src: "@v100@x64@s1y74,20@q3", want: []Node{
+			&ControlChange{At: 0, Command: "@v", Number: 7, Value: 100},
+			&ControlChange{At: 5, Command: "@x", Number: 11, Value: 64},
+			&ControlChange{At: 9, Command: "@s", Number: 64, Value: 1},
+			&ControlChange{At: 12, Command: "y", Number: 74, Value: 20},
+			&Gate{At: 18, Value: 3, Ticks: true},
+		}},
+		{name: "missing y value", src: "y10c", want: []Node{
+			&Note{At: 3, Key: "c", Length: Duration{At: 3}},
+		}, wantErr: "0: missing ',' in y"},
+		{name: "slide", src: "c+&>>d-4^8 e", want: []Node{
+			&Note{At: 0, Key: "c", Accidental: 1, Slide: []Node{
+				&OctaveChange{At: 3, Value: 1, Relative: true},
+				&OctaveChange{At: 4, Value: 1, Relative: true},
+				&Note{At: 5, Key: "d", Accidental: -1, Length: Duration{At: 5}},
+			}, Length: Duration{At: 7, Value: 4}, Ties: []Duration{{At: 9, Value: 8}}},
+			&Note{At: 11, Key: "e", Length: Duration{At: 11}},
+		}},
+		{name: "missing slide note", src: "c&4", want: []Node{
+			&Note{At: 0, Key: "c", Length: Duration{At: 2, Value: 4}},
+		}, wantErr: "1: missing note after '&'"},
+		{name: "bend", src: "@b-100@br12@bs8@b", want: []Node{
+			&PitchBend{At: 0, Value: -100},
+			&BendRange{At: 6, Value: 12},
+			&SlideSteps{At: 11, Value: 8},
+		}, wantErr: `16: missing number after "b"`},
+		{name: "lfo", src: "@lv10,240,100,1@lt0,480,20@lp1@lv0", want: []Node{
+			&LFO{At: 0, Kind: "v", Delay: 10, Rate: 240, Depth: 100, Wave: 1},
+			&LFO{At: 15, Kind: "t", Delay: 0, Rate: 480, Depth: 20},
+			&LFOSwitch{At: 26, Kind: "p", On: true},
+			&LFOSwitch{At: 30, Kind: "v"},
+		}},
+		{name: "unknown lfo", src: "@lx1", want: []Node{}, wantErr: "2: unknown LFO \"x\"\n3: unexpected number 1"},
+		{name: "lfo arguments", src: "@lv1,2", want: []Node{}, wantErr: "0: LFO needs delay,rate,depth[,wave]"},
+		{name: "velocity", src: "()3@vs10@va30c'{c'e}'v~120,1@x~40,%960", want: []Node{
+			&VelocityStep{At: 0, Value: -1},
+			&VelocityStep{At: 1, Value: 3},
+			&VelocityStepSize{At: 3, Value: 10},
+			&Accent{At: 8, Value: 30},
+			&Note{At: 13, Key: "c", Accent: true, Length: Duration{At: 13}},
+			&Chord{At: 15, Body: []Node{
+				&Note{At: 16, Key: "c", Accent: true, Length: Duration{At: 16}},
+				&Note{At: 18, Key: "e", Length: Duration{At: 18}},
+			}, Accent: true, Length: Duration{At: 15}},
+			&Velocity{At: 21, Value: 120, Ramp: true, Length: Duration{At: 27, Value: 1}},
+			&ControlChange{At: 28, Command: "@x", Number: 11, Value: 40, Ramp: true, Length: Duration{At: 34, Value: 960, Ticks: true}},
+		}},
+		{name: "missing velocity ramp length", src: "v~100", want: []Node{}, wantErr: "0: missing ',' in velocity ramp"},
+		{name: "swing", src: "@w60@w66,16@w", want: []Node{
+			&Swing{At: 0, Percent: 60},
+			&Swing{At: 4, Percent: 66, Unit: 16},
+		}, wantErr: `12: missing number after "w"`},
+		{name: "tempo ramp", src: "t~180,4.c", want: []Node{
+			&Tempo{At: 0, Value: 180, Ramp: true, Length: Duration{At: 6, Value: 4, Dot: true}},
+			&Note{At: 8, Key: "c", Length: Duration{At: 8}},
+		}},
+		{name: "missing comma", src: "t~180", want: []Node{}, wantErr: "0: missing ',' in tempo ramp"},
+		{name: "invalid time signature", src: "ts3/6", want: []Node{}, wantErr: "0: invalid time signature 3/6"},
+		{name: "missing slash", src: "ts3c", want: []Node{
+			&Note{At: 3, Key: "c", Length: Duration{At: 3}},
+		}, wantErr: "0: missing '/' in time signature"},
+		{name: "drum", src: "*bd4*sd'^8 {*bd*hh'}8 *oh r", want: []Node{
+			&Drum{At: 0, Name: "bd", Length: Duration{At: 3, Value: 4}},
+			&Drum{At: 4, Name: "sd", Accent: true, Length: Duration{At: 4}, Ties: []Duration{{At: 9, Value: 8}}},
+			&Chord{At: 11, Body: []Node{
+				&Drum{At: 12, Name: "bd", Length: Duration{At: 12}},
+				&Drum{At: 15, Name: "hh", Accent: true, Length: Duration{At: 15}},
+			}, Length: Duration{At: 20, Value: 8}},
+			&Drum{At: 22, Name: "oh", Length: Duration{At: 22}},
+			&Rest{At: 26, Length: Duration{At: 26}},
+		}},
+		{name: "missing drum name", src: "* bd", want: []Node{
+			&Note{At: 2, Key: "b", Length: Duration{At: 2}},
+			&Note{At: 3, Key: "d", Length: Duration{At: 3}},
+		}, wantErr: "0: missing drum name after '*'"},
+		{name: "note number", src: "n60,4.n0'{n36n42'}8n128n", want: []Node{
+			&NoteNumber{At: 0, Value: 60, Length: Duration{At: 4, Value: 4, Dot: true}},
+			&NoteNumber{At: 6, Value: 0, Accent: true, Length: Duration{At: 6}},
+			&Chord{At: 9, Body: []Node{
+				&NoteNumber{At: 10, Value: 36, Length: Duration{At: 10}},
+				&NoteNumber{At: 13, Value: 42, Accent: true, Length: Duration{At: 13}},
+			}, Length: Duration{At: 18, Value: 8}},
+		}, wantErr: "19: invalid note number 128\n23: missing number after \"n\""},
+		{name: "program", src: `@49,8,1@"Acoustic Grand Piano"@"string ensemble 1",8@1,0,3`, want: []Node{
+			&Program{At: 0, Value: 49, MSB: 8, LSB: 1},
+			&Program{At: 7, Value: 1, Name: "Acoustic Grand Piano"},
+			&Program{At: 30, Value: 49, Name: "string ensemble 1", MSB: 8},
+			&Program{At: 52, Value: 1, LSB: 3},
+		}},
+		{name: "program error", src: `@1,128@"Piano"@"Flute`, want: []Node{}, wantErr: "2: invalid bank 128\n7: unknown instrument \"Piano\"\n15: unterminated string"},
+		{name: "unexpected string", src: `c"x"`, want: []Node{
+			&Note{At: 0, Key: "c", Length: Duration{At: 0}},
+		}, wantErr: "1: unexpected string \"x\""},
+		{name: "sysex", src: `x"F0 41 10 42 F7"x"7e7f0901"`, want: []Node{
+			&SysEx{At: 0, Data: []byte{0x41, 0x10, 0x42}},
+			&SysEx{At: 17, Data: []byte{0x7e, 0x7f, 0x09, 0x01}},
+		}},
+		{name: "sysex error", src: `x"GG"x"41 80"x"4"xc`, want: []Node{
+			&Note{At: 18, Key: "c", Length: Duration{At: 18}},
+		}, wantErr: "1: invalid SysEx \"GG\"\n6: invalid SysEx byte 80\n14: invalid SysEx \"4\"\n17: missing string after \"x\""},
+		{name: "marker", src: `m"Verse 1"m`, want: []Node{
+			&Marker{At: 0, Text: "Verse 1"},
+		}, wantErr: `10: missing string after "m"`},
+		{name: "loop point", src: "L c l8 l", want: []Node{
+			&LoopPoint{At: 0},
+			&Note{At: 2, Key: "c", Length: Duration{At: 2}},
+			&Length{At: 4, Value: 8},
+			&LoopPoint{At: 7},
+		}},
+		{name: "sorted errors", src: "[j", want: []Node{
+			&Loop{At: 0, Body: []Node{}},
+		}, wantErr: "0: unclosed '['\n1: unknown command \"j\""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.src)
+			assert.Equal(t, tt.want, got)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.wantErr)
+			}
+		})
+	}
+}
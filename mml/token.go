@@ -0,0 +1,73 @@
+// Package mml は MML の字句解析・構文解析と構文木を提供する
+package mml
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Pos は MML 文字列中のバイトオフセット
+type Pos int
+
+// TokenKind はトークンの種類
+type TokenKind int
+
+const (
+	EOF    TokenKind = iota
+	Char             // 1文字のコマンドや記号
+	Number           // 数字の並び
+	String           // " で囲んだ文字列。Text は " を含み、大文字・小文字と空白をそのまま残す
+)
+
+// Token は MML の字句
+type Token struct {
+	Kind TokenKind
+	Pos  Pos
+	Text string
+}
+
+// Tokenize は MML をトークンに分割する
+// 空白は読み飛ばし、英字は小文字に、# は + にそろえる
+// " から次の " までは1つの String にする。閉じていなければ末尾まで
+func Tokenize(src string) []Token {
+	toks := []Token{}
+	for i := 0; i < len(src); {
+		c := src[i]
+		if c == ' ' || c == '\t' {
+			i++
+			continue
+		}
+		if c == '"' {
+			j := strings.IndexByte(src[i+1:], '"')
+			if j < 0 {
+				j = len(src)
+			} else {
+				j += i + 2
+			}
+			toks = append(toks, Token{Kind: String, Pos: Pos(i), Text: src[i:j]})
+			i = j
+			continue
+		}
+		if isDigit(c) {
+			j := i
+			for j < len(src) && isDigit(src[j]) {
+				j++
+			}
+			toks = append(toks, Token{Kind: Number, Pos: Pos(i), Text: src[i:j]})
+			i = j
+			continue
+		}
+		_, size := utf8.DecodeRuneInString(src[i:])
+		text := strings.ToLower(src[i : i+size])
+		if text == "#" {
+			text = "+"
+		}
+		toks = append(toks, Token{Kind: Char, Pos: Pos(i), Text: text})
+		i += size
+	}
+	return append(toks, Token{Kind: EOF, Pos: Pos(len(src))})
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
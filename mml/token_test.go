@@ -0,0 +1,51 @@
+package mml
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []Token
+	}{
+		{name: "empty", src: "", want: []Token{{Kind: EOF}}},
+		{name: "1桁", src: "1a", want: []Token{
+			{Kind: Number, Pos: 0, Text: "1"},
+			{Kind: Char, Pos: 1, Text: "a"},
+			{Kind: EOF, Pos: 2},
+		}},
+		{name: "2桁", src: "12a", want: []Token{
+			{Kind: Number, Pos: 0, Text: "12"},
+			{Kind: Char, Pos: 2, Text: "a"},
+			{Kind: EOF, Pos: 3},
+		}},
+		{name: "space", src: "C D#", want: []Token{
+			{Kind: Char, Pos: 0, Text: "c"},
+			{Kind: Char, Pos: 2, Text: "d"},
+			{Kind: Char, Pos: 3, Text: "+"},
+			{Kind: EOF, Pos: 4},
+		}},
+		{name: "string", src: `@"Flute A"c"x`, want: []Token{
+			{Kind: Char, Pos: 0, Text: "@"},
+			{Kind: String, Pos: 1, Text: `"Flute A"`},
+			{Kind: Char, Pos: 10, Text: "c"},
+			{Kind: String, Pos: 11, Text: `"x`},
+			{Kind: EOF, Pos: 13},
+		}},
+		{name: "multibyte", src: "cあ", want: []Token{
+			{Kind: Char, Pos: 0, Text: "c"},
+			{Kind: Char, Pos: 1, Text: "あ"},
+			{Kind: EOF, Pos: 4},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Tokenize(tt.src)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}